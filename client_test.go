@@ -1,66 +1,90 @@
-package reality_test
-
-import (
-	"context"
-	"crypto/ecdh"
-	"crypto/ed25519"
-	"crypto/rand"
-	"encoding/base64"
-	"encoding/json"
-	"testing"
-
-	"github.com/howmp/reality"
-)
-
-func TestClient(t *testing.T) {
-
-	privEcdh, err := ecdh.X25519().GenerateKey(rand.Reader)
-	if err != nil {
-		t.Fatal(err)
-	}
-	pubVerify, _, err := ed25519.GenerateKey(rand.Reader)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	config := &reality.ClientConfig{
-		SNI:             "www.qq.com",
-		ServerAddr:      "www.qq.com:443",
-		PublicKeyECDH:   base64.StdEncoding.EncodeToString(privEcdh.Bytes()),
-		PublicKeyVerify: base64.StdEncoding.EncodeToString(pubVerify),
-		Debug:           true,
-	}
-	d, err := json.Marshal(config)
-	if err != nil {
-		t.Fatal(err)
-	}
-	t.Log(string(d))
-
-	_, err = reality.NewClient(context.Background(), config)
-	if err == nil {
-		t.Fatal("should error")
-	}
-
-}
-
-func TestClientConfig(t *testing.T) {
-	configServer, err := reality.NewServerConfig("example.com:443", "127.0.0.1:443")
-	if err != nil {
-		t.Fatal(err)
-	}
-	config := configServer.ToClientConfig(0)
-	configData, err := config.Marshal()
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	newConfig, err := reality.UnmarshalClientConfig(configData)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	if err := newConfig.Validate(); err != nil {
-		t.Fatal(err)
-	}
-
-}
+package reality_test
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/howmp/reality"
+)
+
+func TestClient(t *testing.T) {
+
+	privEcdh, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubVerify, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &reality.ClientConfig{
+		SNI:             "www.qq.com",
+		ServerAddr:      "www.qq.com:443",
+		PublicKeyECDH:   base64.StdEncoding.EncodeToString(privEcdh.Bytes()),
+		PublicKeyVerify: base64.StdEncoding.EncodeToString(pubVerify),
+		Debug:           true,
+	}
+	d, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(string(d))
+
+	_, err = reality.NewClient(context.Background(), config)
+	if err == nil {
+		t.Fatal("should error")
+	}
+
+}
+
+func TestClientConfig(t *testing.T) {
+	configServer, err := reality.NewServerConfig("example.com:443", "127.0.0.1:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := configServer.ToClientConfig(0)
+	configData, err := config.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newConfig, err := reality.UnmarshalClientConfig(configData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := newConfig.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+}
+
+func TestClientEndpoints(t *testing.T) {
+	configServer, err := reality.NewServerConfig("example.com:443", "127.0.0.1:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configServer.Endpoints = []*reality.Endpoint{{Addr: "127.0.0.2:8443", SNI: "www.example.com"}}
+	config := configServer.ToClientConfig(0)
+	endpoints := config.AllEndpoints()
+	if len(endpoints) != 2 || endpoints[0].Addr != "127.0.0.1:443" {
+		t.Fatalf("endpoints %v", endpoints)
+	}
+	c := config.WithEndpoint(endpoints[1])
+	if c.ServerAddr != "127.0.0.2:8443" || c.SNI != "www.example.com" || config.ServerAddr != "127.0.0.1:443" {
+		t.Fatalf("got %s %s", c.ServerAddr, c.SNI)
+	}
+	if c := config.WithEndpoint(endpoints[0]); c.SNI != "example.com" {
+		t.Fatalf("got sni %s", c.SNI)
+	}
+	config.Endpoints = append(config.Endpoints, &reality.Endpoint{Addr: "127.0.0.3"})
+	if err := config.Validate(); err == nil {
+		t.Fatal("endpoint without port should be invalid")
+	}
+}
@@ -0,0 +1,197 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/armon/go-socks5"
+)
+
+// Rule 目标访问规则，格式: "allow|deny 目标[:端口]"
+//
+// 目标可以是*、IP、CIDR或主机名通配符(如*.corp.local)，IPv6需要用[]包裹
+// 端口可以是*、单个端口、端口范围(如8000-9000)或逗号分隔的列表，省略表示任意端口
+type Rule struct {
+	Allow bool
+	text  string
+	any   bool
+	ipNet *net.IPNet
+	host  string
+	ports [][2]int
+}
+
+func (r *Rule) String() string {
+	return r.text
+}
+
+// ParseRule 解析单条规则
+func ParseRule(text string) (*Rule, error) {
+	fields := strings.Fields(text)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid rule %q", text)
+	}
+	r := &Rule{text: text}
+	switch fields[0] {
+	case "allow":
+		r.Allow = true
+	case "deny":
+	default:
+		return nil, fmt.Errorf("invalid rule %q: unknown action %s", text, fields[0])
+	}
+	dest, ports := splitDestPorts(fields[1])
+	if err := r.parsePorts(ports); err != nil {
+		return nil, fmt.Errorf("invalid rule %q: %v", text, err)
+	}
+	switch {
+	case dest == "*":
+		r.any = true
+	case strings.Contains(dest, "/"):
+		_, ipNet, err := net.ParseCIDR(dest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %v", text, err)
+		}
+		r.ipNet = ipNet
+	case net.ParseIP(dest) != nil:
+		ip := net.ParseIP(dest)
+		bits := 8 * len(ip.To16())
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		r.ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	default:
+		r.host = strings.ToLower(dest)
+		if _, err := path.Match(r.host, ""); err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %v", text, err)
+		}
+	}
+	return r, nil
+}
+
+// splitDestPorts 拆分目标和端口，IPv6目标需要用[]包裹
+func splitDestPorts(s string) (dest, ports string) {
+	if strings.HasPrefix(s, "[") {
+		if end := strings.Index(s, "]"); end != -1 {
+			dest, ports = s[1:end], strings.TrimPrefix(s[end+1:], ":")
+			return
+		}
+	}
+	if strings.Count(s, ":") == 1 {
+		i := strings.Index(s, ":")
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+func (r *Rule) parsePorts(s string) error {
+	if s == "" || s == "*" {
+		return nil
+	}
+	for _, p := range strings.Split(s, ",") {
+		lo, hi, found := strings.Cut(p, "-")
+		if !found {
+			hi = lo
+		}
+		start, err := strconv.ParseUint(lo, 10, 16)
+		if err != nil {
+			return err
+		}
+		end, err := strconv.ParseUint(hi, 10, 16)
+		if err != nil {
+			return err
+		}
+		if start > end {
+			return fmt.Errorf("invalid port range %s", p)
+		}
+		r.ports = append(r.ports, [2]int{int(start), int(end)})
+	}
+	return nil
+}
+
+// Match 判断目标是否匹配规则，fqdn为空表示直接使用IP访问
+func (r *Rule) Match(fqdn string, ip net.IP, port int) bool {
+	if len(r.ports) > 0 {
+		matched := false
+		for _, p := range r.ports {
+			if port >= p[0] && port <= p[1] {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	switch {
+	case r.any:
+		return true
+	case r.ipNet != nil:
+		return ip != nil && r.ipNet.Contains(ip)
+	default:
+		if fqdn == "" {
+			return false
+		}
+		matched, _ := path.Match(r.host, strings.ToLower(strings.TrimSuffix(fqdn, ".")))
+		return matched
+	}
+}
+
+// ParseRules 解析规则列表
+func ParseRules(texts []string) ([]*Rule, error) {
+	rules := make([]*Rule, 0, len(texts))
+	for _, text := range texts {
+		r, err := ParseRule(text)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// RuleSet 实现socks5.RuleSet，按顺序匹配规则，第一条匹配的规则生效，均不匹配则允许
+type RuleSet struct {
+	rules []*Rule
+	lock  sync.RWMutex
+	// OnDeny 拒绝访问时回调
+	OnDeny func(req *socks5.Request, rule *Rule)
+}
+
+var _ socks5.RuleSet = (*RuleSet)(nil)
+
+func NewRuleSet(rules []*Rule, onDeny func(req *socks5.Request, rule *Rule)) *RuleSet {
+	return &RuleSet{rules: rules, OnDeny: onDeny}
+}
+
+// SetRules 运行时替换规则
+func (rs *RuleSet) SetRules(rules []*Rule) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.rules = rules
+}
+
+func (rs *RuleSet) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	dest := req.DestAddr
+	rule, allow := rs.Check(dest.FQDN, dest.IP, dest.Port)
+	if !allow && rs.OnDeny != nil {
+		rs.OnDeny(req, rule)
+	}
+	return ctx, allow
+}
+
+// Check 返回第一条匹配的规则及是否允许访问，均不匹配返回nil和true
+func (rs *RuleSet) Check(fqdn string, ip net.IP, port int) (*Rule, bool) {
+	rs.lock.RLock()
+	rules := rs.rules
+	rs.lock.RUnlock()
+	for _, r := range rules {
+		if r.Match(fqdn, ip, port) {
+			return r, r.Allow
+		}
+	}
+	return nil, true
+}
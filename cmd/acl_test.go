@@ -0,0 +1,145 @@
+package cmd_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/armon/go-socks5"
+	"github.com/howmp/reality/cmd"
+)
+
+func TestRuleMatch(t *testing.T) {
+	cases := []struct {
+		rule  string
+		fqdn  string
+		ip    string
+		port  int
+		match bool
+	}{
+		{"deny 10.0.0.0/8", "", "10.1.2.3", 80, true},
+		{"deny 10.0.0.0/8", "", "192.168.1.1", 80, false},
+		{"deny 10.0.0.0/8", "admin.corp", "10.1.2.3", 80, true},
+		{"deny 10.0.0.5:22", "", "10.0.0.5", 22, true},
+		{"deny 10.0.0.5:22", "", "10.0.0.5", 23, false},
+		{"allow *:80,443", "", "1.1.1.1", 443, true},
+		{"allow *:8000-9000", "", "1.1.1.1", 8080, true},
+		{"allow *:8000-9000", "", "1.1.1.1", 9001, false},
+		{"deny *.corp.local", "db.corp.local", "", 3306, true},
+		{"deny *.corp.local", "DB.Corp.Local.", "", 3306, true},
+		{"deny *.corp.local", "corp.local", "", 3306, false},
+		{"deny [fd00::/8]:443", "", "fd00::1", 443, true},
+		{"deny fd00::1", "", "fd00::1", 443, true},
+	}
+	for _, c := range cases {
+		r, err := cmd.ParseRule(c.rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := r.Match(c.fqdn, net.ParseIP(c.ip), c.port); got != c.match {
+			t.Errorf("%q match %s %s %d: got %v, want %v", c.rule, c.fqdn, c.ip, c.port, got, c.match)
+		}
+	}
+	for _, text := range []string{"deny", "block *", "deny 10.0.0.0/33", "allow *:99999", "allow *:9-1"} {
+		if _, err := cmd.ParseRule(text); err == nil {
+			t.Errorf("%q should be invalid", text)
+		}
+	}
+}
+
+type staticResolver struct{}
+
+func (staticResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, net.IPv4(127, 0, 0, 1), nil
+}
+
+// socksConnect 简单的socks5客户端，返回服务端回复码
+func socksConnect(conn net.Conn, host string, port int) (byte, error) {
+	req := []byte{5, 1, 0, 5, 1, 0, 3, byte(len(host))}
+	req = append(req, host...)
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	resp := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return 0, err
+	}
+	if resp[0] != 5 || resp[1] != 0 {
+		return 0, errors.New("socks5 auth failed")
+	}
+	return resp[3], nil
+}
+
+func TestRuleSetSocks(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := target.Addr().(*net.TCPAddr).Port
+
+	rules, err := cmd.ParseRules([]string{"deny *.admin.corp", fmt.Sprintf("allow 127.0.0.1:%d", port), "deny *"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	denied := make(chan string, 10)
+	server, err := socks5.New(&socks5.Config{
+		Resolver: staticResolver{},
+		Rules: cmd.NewRuleSet(rules, func(req *socks5.Request, rule *cmd.Rule) {
+			denied <- rule.String()
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go server.Serve(l)
+
+	cases := []struct {
+		host  string
+		port  int
+		reply byte
+		rule  string
+	}{
+		{"app.corp", port, 0, ""},
+		{"db.admin.corp", port, 2, "deny *.admin.corp"},
+		{"app.corp", port + 1, 2, "deny *"},
+	}
+	for _, c := range cases {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, err := socksConnect(conn, c.host, c.port)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply != c.reply {
+			t.Fatalf("%s:%d: got reply %d, want %d", c.host, c.port, reply, c.reply)
+		}
+		if c.rule != "" {
+			if rule := <-denied; rule != c.rule {
+				t.Fatalf("%s:%d: denied by %q, want %q", c.host, c.port, rule, c.rule)
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"errors"
+	"io"
+)
+
+// 用户端认证结果
+const (
+	AuthOK     byte = 0
+	AuthFailed byte = 1 // 用户名或密码错误
+	AuthDenied byte = 2 // 无权访问该客户端
+)
+
+var (
+	ErrAuthFailed = errors.New("auth failed")
+	ErrAuthDenied = errors.New("auth denied")
+)
+
+// WriteAuth 用户端发送认证信息，格式: 用户名长度(1) 用户名 密码长度(1) 密码
+func WriteAuth(w io.Writer, user, password string) error {
+	if len(user) > 255 || len(password) > 255 {
+		return errors.New("user or password too long")
+	}
+	data := make([]byte, 0, 2+len(user)+len(password))
+	data = append(data, byte(len(user)))
+	data = append(data, user...)
+	data = append(data, byte(len(password)))
+	data = append(data, password...)
+	_, err := w.Write(data)
+	return err
+}
+
+// ReadAuth 服务端读取认证信息
+func ReadAuth(r io.Reader) (user, password string, err error) {
+	if user, err = readString(r); err != nil {
+		return
+	}
+	password, err = readString(r)
+	return
+}
+
+// WriteAuthResult 服务端回复认证结果
+func WriteAuthResult(w io.Writer, result byte) error {
+	_, err := w.Write([]byte{result})
+	return err
+}
+
+// ReadAuthResult 用户端读取认证结果
+func ReadAuthResult(r io.Reader) error {
+	result := make([]byte, 1)
+	if _, err := io.ReadFull(r, result); err != nil {
+		return err
+	}
+	switch result[0] {
+	case AuthOK:
+		return nil
+	case AuthDenied:
+		return ErrAuthDenied
+	default:
+		return ErrAuthFailed
+	}
+}
+
+func readString(r io.Reader) (string, error) {
+	l := make([]byte, 1)
+	if _, err := io.ReadFull(r, l); err != nil {
+		return "", err
+	}
+	data := make([]byte, l[0])
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
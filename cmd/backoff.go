@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/howmp/reality"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrAllEndpointsFailed 所有服务端地址都连接失败，每个地址的失败原因已记录日志
+var ErrAllEndpointsFailed = errors.New("all server endpoints failed")
+
+const (
+	DefaultReconnectMin = 5 * time.Second
+	DefaultReconnectMax = 5 * time.Minute
+)
+
+// Backoff 指数退避，每次失败等待时间翻倍直到Max，实际等待时间在[d/2, d]之间随机
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+
+	lock    sync.Mutex
+	attempt int
+}
+
+// Next 返回下次重连前的等待时间
+func (b *Backoff) Next() time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	min, max := b.Min, b.Max
+	if min <= 0 {
+		min = DefaultReconnectMin
+	}
+	if max < min {
+		max = min
+	}
+	d := min
+	for i := 0; i < b.attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	b.attempt++
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// Reset 连接成功后重置
+func (b *Backoff) Reset() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.attempt = 0
+}
+
+// Connector 依次尝试配置中的服务端地址，从上次成功的地址开始
+type Connector struct {
+	Config *reality.ClientConfig
+	Logger logrus.FieldLogger
+
+	lock sync.Mutex
+	next int
+}
+
+// Connect 所有地址都失败时返回ErrAllEndpointsFailed
+func (c *Connector) Connect(ctx context.Context) (net.Conn, *reality.Endpoint, error) {
+	endpoints := c.Config.AllEndpoints()
+	c.lock.Lock()
+	start := c.next % len(endpoints)
+	c.lock.Unlock()
+	for i := range endpoints {
+		index := (start + i) % len(endpoints)
+		endpoint := endpoints[index]
+		conn, err := reality.NewClient(ctx, c.Config.WithEndpoint(endpoint))
+		if err != nil {
+			c.Logger.Warnf("connect %s: %v", endpoint, err)
+			continue
+		}
+		c.lock.Lock()
+		c.next = index
+		c.lock.Unlock()
+		return conn, endpoint, nil
+	}
+	return nil, nil, ErrAllEndpointsFailed
+}
+
+// Skip 下次连接从上次成功地址的下一个开始，用于服务端通知即将关闭时
+func (c *Connector) Skip() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.next++
+}
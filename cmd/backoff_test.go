@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/howmp/reality"
+)
+
+func TestBackoff(t *testing.T) {
+	b := &Backoff{Min: time.Second, Max: 8 * time.Second}
+	for _, want := range []time.Duration{1, 2, 4, 8, 8} {
+		want *= time.Second
+		if d := b.Next(); d < want/2 || d > want {
+			t.Fatalf("got %s, want [%s, %s]", d, want/2, want)
+		}
+	}
+	b.Reset()
+	if d := b.Next(); d > time.Second {
+		t.Fatalf("got %s after reset", d)
+	}
+}
+
+func TestConnector(t *testing.T) {
+	serverConfig, err := reality.NewServerConfig("example.com:443", "127.0.0.1:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 每个地址接受连接后立即关闭，握手失败
+	var counts [2]int32
+	addrs := make([]string, len(counts))
+	for i := range counts {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		addrs[i] = l.Addr().String()
+		count := &counts[i]
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				atomic.AddInt32(count, 1)
+				conn.Close()
+			}
+		}()
+	}
+	config := serverConfig.ToClientConfig(0)
+	config.ServerAddr = addrs[0]
+	config.Endpoints = []*reality.Endpoint{{Addr: addrs[1], SNI: "www.example.com"}}
+	c := &Connector{Config: config, Logger: reality.GetLogger(false)}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, _, err := c.Connect(ctx); err != ErrAllEndpointsFailed {
+		t.Fatalf("got %v", err)
+	}
+	if atomic.LoadInt32(&counts[0]) != 1 || atomic.LoadInt32(&counts[1]) != 1 {
+		t.Fatalf("attempts %v", counts)
+	}
+}
@@ -0,0 +1,336 @@
+package cmd
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	DNSTimeout   = 5 * time.Second
+	dnsCacheSize = 4096
+	dnsLocalTTL  = 60 // 使用系统解析时应答的TTL
+	dnsMaxTTL    = 3600
+)
+
+// WriteDNSMessage 发送DNS报文，格式与DNS over TCP一致: 长度(2) DNS报文
+func WriteDNSMessage(w io.Writer, msg []byte) error {
+	if len(msg) > 0xFFFF {
+		return errors.New("dns message too large")
+	}
+	buf := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+func ReadDNSMessage(r io.Reader) ([]byte, error) {
+	size := make([]byte, 2)
+	if _, err := io.ReadFull(r, size); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(size))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+type dnsCacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+}
+
+type dnsCacheEntry struct {
+	msg    []byte
+	stored time.Time
+	expire time.Time
+}
+
+// DNSForwarder 按Resolver选择的上游转发DNS查询，未指定上游时使用系统解析应答A和AAAA查询，成功的应答按最小TTL缓存
+type DNSForwarder struct {
+	resolver *Resolver
+	lock     sync.Mutex
+	cache    map[dnsCacheKey]*dnsCacheEntry
+}
+
+func NewDNSForwarder(resolver *Resolver) *DNSForwarder {
+	return &DNSForwarder{resolver: resolver, cache: make(map[dnsCacheKey]*dnsCacheEntry)}
+}
+
+// FlushCache 上游变化后清空缓存
+func (f *DNSForwarder) FlushCache() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.cache = make(map[dnsCacheKey]*dnsCacheEntry)
+}
+
+// ServeStream 循环处理流上的DNS查询，直到流关闭
+func (f *DNSForwarder) ServeStream(stream io.ReadWriter, logger logrus.FieldLogger) error {
+	for {
+		query, err := ReadDNSMessage(stream)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		resp, err := f.Exchange(context.Background(), query)
+		if err != nil {
+			logger.Errorf("dns exchange: %v", err)
+		}
+		if resp == nil {
+			continue
+		}
+		if err := WriteDNSMessage(stream, resp); err != nil {
+			return err
+		}
+	}
+}
+
+// Exchange 处理一个DNS查询，出错时若查询可以解析仍返回SERVFAIL应答
+func (f *DNSForwarder) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	key := dnsCacheKey{strings.ToLower(q.Name.String()), q.Type, q.Class}
+	if resp := f.cached(key, hdr.ID); resp != nil {
+		return resp, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, DNSTimeout)
+	defer cancel()
+	var resp []byte
+	if server := f.resolver.ServerFor(q.Name.String()); server != "" {
+		resp, err = exchangeUpstream(ctx, server, query)
+	} else {
+		resp, err = f.resolveLocal(ctx, hdr, q)
+	}
+	if err != nil {
+		resp, _ = dnsReply(hdr, q, dnsmessage.RCodeServerFailure, nil)
+		return resp, err
+	}
+	f.store(key, resp)
+	return resp, nil
+}
+
+func (f *DNSForwarder) cached(key dnsCacheKey, id uint16) []byte {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	entry, ok := f.cache[key]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if now.After(entry.expire) {
+		delete(f.cache, key)
+		return nil
+	}
+	resp, err := ageTTL(entry.msg, uint32(now.Sub(entry.stored)/time.Second))
+	if err != nil {
+		delete(f.cache, key)
+		return nil
+	}
+	binary.BigEndian.PutUint16(resp, id)
+	return resp
+}
+
+// ageTTL 返回各记录的TTL减去在缓存中经过的秒数后的应答，OPT记录的TTL字段不是TTL，保持不变
+func ageTTL(msg []byte, elapsed uint32) ([]byte, error) {
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil {
+		return nil, err
+	}
+	for _, section := range [][]dnsmessage.Resource{m.Answers, m.Authorities, m.Additionals} {
+		for i := range section {
+			h := &section[i].Header
+			if h.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			if h.TTL > elapsed {
+				h.TTL -= elapsed
+			} else {
+				h.TTL = 0
+			}
+		}
+	}
+	return m.Pack()
+}
+
+// store 只缓存有应答记录的成功应答，缓存满时先清理过期项，仍然满时随机淘汰
+func (f *DNSForwarder) store(key dnsCacheKey, resp []byte) {
+	ttl, ok := answerTTL(resp)
+	if !ok || ttl == 0 {
+		return
+	}
+	if ttl > dnsMaxTTL {
+		ttl = dnsMaxTTL
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if len(f.cache) >= dnsCacheSize {
+		now := time.Now()
+		for k, v := range f.cache {
+			if now.After(v.expire) {
+				delete(f.cache, k)
+			}
+		}
+		for k := range f.cache {
+			if len(f.cache) < dnsCacheSize {
+				break
+			}
+			delete(f.cache, k)
+		}
+	}
+	now := time.Now()
+	f.cache[key] = &dnsCacheEntry{msg: resp, stored: now, expire: now.Add(time.Duration(ttl) * time.Second)}
+}
+
+// answerTTL 返回应答记录中最小的TTL
+func answerTTL(resp []byte) (uint32, bool) {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(resp)
+	if err != nil || hdr.RCode != dnsmessage.RCodeSuccess || hdr.Truncated {
+		return 0, false
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return 0, false
+	}
+	answers, err := p.AllAnswers()
+	if err != nil || len(answers) == 0 {
+		return 0, false
+	}
+	ttl := answers[0].Header.TTL
+	for _, a := range answers[1:] {
+		if a.Header.TTL < ttl {
+			ttl = a.Header.TTL
+		}
+	}
+	return ttl, true
+}
+
+// exchangeUpstream 通过UDP查询上游，应答被截断时改用TCP
+func exchangeUpstream(ctx context.Context, server string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0xFFFF)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// 忽略ID不匹配的应答
+		if n < 12 || buf[0] != query[0] || buf[1] != query[1] {
+			continue
+		}
+		var p dnsmessage.Parser
+		hdr, err := p.Start(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		if !hdr.Truncated {
+			return append([]byte(nil), buf[:n]...), nil
+		}
+		break
+	}
+
+	tcpConn, err := d.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer tcpConn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		tcpConn.SetDeadline(deadline)
+	}
+	if err := WriteDNSMessage(tcpConn, query); err != nil {
+		return nil, err
+	}
+	return ReadDNSMessage(tcpConn)
+}
+
+// resolveLocal 使用系统解析应答A和AAAA查询，其他类型返回NOTIMP
+func (f *DNSForwarder) resolveLocal(ctx context.Context, hdr dnsmessage.Header, q dnsmessage.Question) ([]byte, error) {
+	network := ""
+	switch q.Type {
+	case dnsmessage.TypeA:
+		network = "ip4"
+	case dnsmessage.TypeAAAA:
+		network = "ip6"
+	}
+	if network == "" || q.Class != dnsmessage.ClassINET {
+		return dnsReply(hdr, q, dnsmessage.RCodeNotImplemented, nil)
+	}
+	name := strings.TrimSuffix(q.Name.String(), ".")
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return dnsReply(hdr, q, dnsmessage.RCodeSuccess, nil)
+		}
+		return nil, err
+	}
+	return dnsReply(hdr, q, dnsmessage.RCodeSuccess, ips)
+}
+
+// dnsReply 构造应答
+func dnsReply(hdr dnsmessage.Header, q dnsmessage.Question, rcode dnsmessage.RCode, ips []net.IP) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 hdr.ID,
+		Response:           true,
+		OpCode:             hdr.OpCode,
+		RecursionDesired:   hdr.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: dnsLocalTTL}
+		var err error
+		if ip4 := ip.To4(); ip4 != nil {
+			var a dnsmessage.AResource
+			copy(a.A[:], ip4)
+			err = b.AResource(rh, a)
+		} else {
+			var aaaa dnsmessage.AAAAResource
+			copy(aaaa.AAAA[:], ip)
+			err = b.AAAAResource(rh, aaaa)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startDNS 启动只应答A记录的UDP DNS服务，返回地址和查询次数
+func startDNS(t *testing.T, ip [4]byte) (string, *int32) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var count int32
+	go func() {
+		buf := make([]byte, 0xFFFF)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&count, 1)
+			var p dnsmessage.Parser
+			hdr, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			msg := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: hdr.ID, Response: true},
+				Questions: []dnsmessage.Question{q},
+				Answers: []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &dnsmessage.AResource{A: ip},
+				}},
+			}
+			resp, _ := msg.Pack()
+			conn.WriteTo(resp, from)
+		}
+	}()
+	return conn.LocalAddr().String(), &count
+}
+
+func newQuery(t *testing.T, id uint16, name string) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query
+}
+
+func parseA(t *testing.T, resp []byte) (uint16, [4]byte) {
+	t.Helper()
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Answers) != 1 {
+		t.Fatalf("answers %v", msg.Answers)
+	}
+	return msg.Header.ID, msg.Answers[0].Body.(*dnsmessage.AResource).A
+}
+
+func TestResolverServerFor(t *testing.T) {
+	r := &Resolver{}
+	r.SetServer("10.0.0.1:53")
+	r.SetUpstreams(map[string]string{"corp": "10.0.0.2:53", ".site3.corp.": "10.0.0.3:53"})
+	cases := map[string]string{
+		"www.qq.com":      "10.0.0.1:53",
+		"corp":            "10.0.0.2:53",
+		"git.corp.":       "10.0.0.2:53",
+		"GIT.Site3.corp":  "10.0.0.3:53",
+		"notsite3.corp":   "10.0.0.2:53",
+		"example.notcorp": "10.0.0.1:53",
+	}
+	for name, want := range cases {
+		if got := r.ServerFor(name); got != want {
+			t.Fatalf("%s: got %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestDNSForwarder(t *testing.T) {
+	defaultServer, defaultCount := startDNS(t, [4]byte{1, 1, 1, 1})
+	corpServer, corpCount := startDNS(t, [4]byte{10, 0, 0, 1})
+	r := &Resolver{}
+	r.SetServer(defaultServer)
+	r.SetUpstreams(map[string]string{"corp": corpServer})
+	f := NewDNSForwarder(r)
+
+	for i, want := range map[string][4]byte{"www.qq.com.": {1, 1, 1, 1}, "git.corp.": {10, 0, 0, 1}} {
+		resp, err := f.Exchange(context.Background(), newQuery(t, 1, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ip := parseA(t, resp); ip != want {
+			t.Fatalf("%s: got %v, want %v", i, ip, want)
+		}
+	}
+
+	// 缓存命中时不再查询上游，应答ID与查询一致
+	resp, err := f.Exchange(context.Background(), newQuery(t, 2, "GIT.corp."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := parseA(t, resp); id != 2 {
+		t.Fatalf("id %d", id)
+	}
+	if atomic.LoadInt32(defaultCount) != 1 || atomic.LoadInt32(corpCount) != 1 {
+		t.Fatalf("upstream queries %d %d", *defaultCount, *corpCount)
+	}
+
+	// 缓存的应答TTL随时间减少
+	f.lock.Lock()
+	for _, entry := range f.cache {
+		entry.stored = entry.stored.Add(-10 * time.Second)
+	}
+	f.lock.Unlock()
+	resp, err = f.Exchange(context.Background(), newQuery(t, 4, "git.corp."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != 4 || len(m.Answers) != 1 || m.Answers[0].Header.TTL != 50 {
+		t.Fatalf("cached answer %+v", m)
+	}
+	f.FlushCache()
+	if _, err := f.Exchange(context.Background(), newQuery(t, 3, "git.corp.")); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(corpCount) != 2 {
+		t.Fatal("cache should be flushed")
+	}
+
+	if _, err := f.Exchange(context.Background(), []byte{1, 2, 3}); err == nil {
+		t.Fatal("invalid query should fail")
+	}
+}
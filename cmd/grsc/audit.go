@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/howmp/reality/cmd"
+)
+
+// auditEntry 记录一个流的目标和结果，流结束后上报服务端
+type auditEntry struct {
+	upload   int64
+	download int64
+
+	lock sync.Mutex
+	msg  cmd.AuditMessage
+}
+
+func newAuditEntry(id uint64, streamType byte) *auditEntry {
+	return &auditEntry{msg: cmd.AuditMessage{ID: id, Type: streamType, Start: time.Now()}}
+}
+
+func (e *auditEntry) setDest(dest string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.msg.Dest = dest
+}
+
+func (e *auditEntry) setResolved(addr string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.msg.Resolved = addr
+}
+
+// setResult 只保留第一个结果，之后的错误通常是由它引起的
+func (e *auditEntry) setResult(result string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.msg.Result == "" {
+		e.msg.Result = result
+	}
+}
+
+// finish 流结束时调用，err为处理流返回的错误
+func (e *auditEntry) finish(err error) *cmd.AuditMessage {
+	if err != nil {
+		e.setResult(err.Error())
+	}
+	e.setResult("ok")
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	msg := e.msg
+	msg.Upload = atomic.LoadInt64(&e.upload)
+	msg.Download = atomic.LoadInt64(&e.download)
+	msg.DurationMS = time.Since(msg.Start).Milliseconds()
+	return &msg
+}
+
+// udpDest 记录UDP关联的第一个目标和结果，之后的数据报不再记录
+func (e *auditEntry) udpDest(addr *socks5.AddrSpec, err error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.msg.Dest != "" {
+		return
+	}
+	e.msg.Dest = addrString(addr)
+	if addr.IP != nil {
+		e.msg.Resolved = net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port))
+	}
+	if err != nil && e.msg.Result == "" {
+		e.msg.Result = err.Error()
+	}
+}
+
+// auditConn 统计流的字节数，读为上行，写为下行
+type auditConn struct {
+	net.Conn
+	entry *auditEntry
+}
+
+func (c *auditConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.entry.upload, int64(n))
+	return n, err
+}
+
+func (c *auditConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.entry.download, int64(n))
+	return n, err
+}
+
+// addrString 优先使用域名，与用户请求的目标一致
+func addrString(addr *socks5.AddrSpec) string {
+	host := addr.FQDN
+	if host == "" {
+		host = addr.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(addr.Port))
+}
+
+// auditRules 检查规则时记录目标
+type auditRules struct {
+	rules socks5.RuleSet
+	entry *auditEntry
+}
+
+func (r *auditRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	r.entry.setDest(addrString(req.DestAddr))
+	ctx, ok := r.rules.Allow(ctx, req)
+	if !ok {
+		r.entry.setResult("denied")
+	}
+	return ctx, ok
+}
+
+// auditResolver 解析失败时记录域名，socks5在检查规则前解析
+type auditResolver struct {
+	resolver socks5.NameResolver
+	entry    *auditEntry
+}
+
+func (r *auditResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ctx, ip, err := r.resolver.Resolve(ctx, name)
+	if err != nil {
+		r.entry.setDest(name)
+		r.entry.setResult("resolve: " + err.Error())
+	}
+	return ctx, ip, err
+}
+
+// dial 记录实际连接的地址和连接结果
+func (e *auditEntry) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	e.setResolved(addr)
+	d := net.Dialer{Timeout: dialTimeout}
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		e.setResult("dial: " + err.Error())
+		return nil, err
+	}
+	e.setResult("ok")
+	return conn, nil
+}
+
+// newSocksServer 每个流使用单独的socks5服务，以便记录该流的审计信息
+func (c *client) newSocksServer(e *auditEntry) (*socks5.Server, error) {
+	return socks5.New(&socks5.Config{
+		Rules:    &auditRules{rules: c.rules, entry: e},
+		Resolver: &auditResolver{resolver: c.resolver, entry: e},
+		Dial:     e.dial,
+		Logger:   c.socksLogger,
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/hashicorp/yamux"
+	"github.com/howmp/reality"
+	"github.com/howmp/reality/cmd"
+	"github.com/sirupsen/logrus"
+)
+
+// openUDP 打开UDP流并向addr发送数据报，目标收到后关闭流
+func openUDP(t *testing.T, session *yamux.Session, id uint64, target *net.UDPConn, ports ...int) {
+	t.Helper()
+	stream, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if err := cmd.WriteStreamType(stream, cmd.StreamUDP); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.WriteStreamID(stream, id); err != nil {
+		t.Fatal(err)
+	}
+	for _, port := range ports {
+		if err := cmd.WriteDatagram(stream, &socks5.AddrSpec{FQDN: "localhost", Port: port}, []byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	target.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := target.ReadFromUDP(make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestAuditUDP 服务端开启审计后才上报，UDP关联记录第一个数据报的目标
+func TestAuditUDP(t *testing.T) {
+	c := newTestClient(t)
+	session := newTestSession(t, c)
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	port := target.LocalAddr().(*net.UDPAddr).Port
+
+	openUDP(t, session, 6, target, port)
+	select {
+	case item := <-c.reports:
+		t.Fatalf("audit reported without server audit: %+v", item.v)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if e := pushPolicy(t, session, &reality.ClientPolicy{Audit: true}); e != "" {
+		t.Fatal(e)
+	}
+	openUDP(t, session, 7, target, port, port+1)
+	select {
+	case item := <-c.reports:
+		m, ok := item.v.(*cmd.AuditMessage)
+		if !ok || m.ID != 7 || m.Type != cmd.StreamUDP || m.Result != "ok" {
+			t.Fatalf("audit %+v", item.v)
+		}
+		if m.Dest != net.JoinHostPort("localhost", strconv.Itoa(port)) || m.Resolved == "" {
+			t.Fatalf("audit dest %q resolved %q", m.Dest, m.Resolved)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no audit report")
+	}
+}
+
+// lockedBuffer 供日志并发写入
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+// TestSocksLogger go-socks5的错误写入客户端的日志
+func TestSocksLogger(t *testing.T) {
+	c := newTestClient(t)
+	var out lockedBuffer
+	c.logger.SetOutput(&out)
+	c.logger.SetFormatter(&logrus.JSONFormatter{})
+	session := newTestSession(t, c)
+	stream, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if err := cmd.WriteStreamType(stream, cmd.StreamSocks); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.WriteStreamID(stream, 1); err != nil {
+		t.Fatal(err)
+	}
+	stream.Write([]byte{4}) // 不支持的socks版本
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(out.String(), `"level":"error","msg":"[ERR] socks:`) {
+		if time.Now().After(deadline) {
+			t.Fatalf("socks error not logged: %s", out.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/howmp/reality"
+	"github.com/howmp/reality/cmd"
+)
+
+const dialTimeout = 10 * time.Second
+
+// handleForward 处理端口转发流，直接连接流头部指定的目标，同样受目标访问规则限制
+func (c *client) handleForward(conn net.Conn, entry *auditEntry) error {
+	addr, err := cmd.ReadAddr(conn)
+	if err != nil {
+		c.logger.Errorf("forward read addr: %v", err)
+		return err
+	}
+	entry.setDest(addrString(addr))
+	target, reply, err := c.dialForward(addr)
+	if err != nil {
+		c.logger.Errorf("forward %s: %v", addr, err)
+		conn.Write([]byte{reply})
+		return err
+	}
+	defer target.Close()
+	entry.setResolved(target.RemoteAddr().String())
+	if _, err := conn.Write([]byte{cmd.SocksReplySuccess}); err != nil {
+		return err
+	}
+	c.logger.Infof("forward %s", addr)
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+	return nil
+}
+
+// dialForward 解析并检查目标后连接，失败时返回对应的socks5回复码
+func (c *client) dialForward(addr *socks5.AddrSpec) (net.Conn, byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	if addr.FQDN != "" {
+		_, ip, err := c.resolver.Resolve(ctx, addr.FQDN)
+		if err != nil {
+			return nil, cmd.SocksReplyHostUnreachable, err
+		}
+		addr.IP = ip
+	}
+	req := &socks5.Request{Command: cmd.SocksCommandConnect, DestAddr: addr}
+	if _, allow := c.rules.Allow(ctx, req); !allow {
+		return nil, cmd.SocksReplyRuleFailure, errors.New("blocked by rules")
+	}
+	var d net.Dialer
+	target, err := d.DialContext(ctx, "tcp", addr.Address())
+	if err != nil {
+		return nil, cmd.SocksReplyHostUnreachable, err
+	}
+	return target, cmd.SocksReplySuccess, nil
+}
+
+// reverseForward 客户端反向端口转发的监听，目标可随策略更新
+type reverseForward struct {
+	listener net.Listener
+	target   atomic.Pointer[socks5.AddrSpec]
+}
+
+// forwardPlan 准备好的反向端口转发，新增的监听已打开，apply后开始接收连接
+type forwardPlan struct {
+	targets map[string]*socks5.AddrSpec // 按监听地址
+	opened  map[string]net.Listener
+}
+
+// prepareForwards 解析策略中的目标并打开新增的监听，任一失败时关闭本次打开的监听，不影响已有的转发
+func (c *client) prepareForwards(forwards []*reality.ClientForward) (*forwardPlan, error) {
+	c.forwardsLock.Lock()
+	defer c.forwardsLock.Unlock()
+	plan := &forwardPlan{targets: make(map[string]*socks5.AddrSpec), opened: make(map[string]net.Listener)}
+	for _, f := range forwards {
+		if _, ok := plan.targets[f.Listen]; ok {
+			plan.abort()
+			return nil, fmt.Errorf("reverse forward %s: duplicate listen", f.Listen)
+		}
+		target, err := cmd.ParseAddr(f.Target)
+		if err != nil {
+			plan.abort()
+			return nil, fmt.Errorf("reverse forward %s: %w", f.Listen, err)
+		}
+		plan.targets[f.Listen] = target
+		if _, ok := c.forwards[f.Listen]; ok {
+			continue
+		}
+		l, err := net.Listen("tcp", f.Listen)
+		if err != nil {
+			plan.abort()
+			return nil, fmt.Errorf("reverse forward %s: %w", f.Listen, err)
+		}
+		plan.opened[f.Listen] = l
+	}
+	return plan, nil
+}
+
+// abort 策略未生效，关闭本次打开的监听
+func (p *forwardPlan) abort() {
+	for _, l := range p.opened {
+		l.Close()
+	}
+}
+
+// applyForwards 关闭策略中已移除的监听，更新已有监听的目标，开始接收新增监听的连接
+func (c *client) applyForwards(plan *forwardPlan) {
+	c.forwardsLock.Lock()
+	defer c.forwardsLock.Unlock()
+	if c.forwards == nil {
+		c.forwards = make(map[string]*reverseForward)
+	}
+	for listen, f := range c.forwards {
+		if _, ok := plan.targets[listen]; !ok {
+			f.listener.Close()
+			delete(c.forwards, listen)
+		}
+	}
+	for listen, target := range plan.targets {
+		f, ok := c.forwards[listen]
+		if !ok {
+			f = &reverseForward{listener: plan.opened[listen]}
+			c.forwards[listen] = f
+			go c.serveReverseForward(f)
+		}
+		f.target.Store(target)
+		c.logger.Infof("reverse forward %s -> %s", listen, target.Address())
+	}
+}
+
+// serveReverseForward 接收本地连接，打开端口转发流由服务端连接目标
+func (c *client) serveReverseForward(f *reverseForward) {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			c.logger.Infof("reverse forward %s closed: %v", f.listener.Addr(), err)
+			return
+		}
+		go c.handleReverseForward(conn, f.target.Load())
+	}
+}
+
+func (c *client) handleReverseForward(conn net.Conn, target *socks5.AddrSpec) {
+	defer conn.Close()
+	stream, err := c.openStream(cmd.StreamForward)
+	if err != nil {
+		c.logger.Errorf("reverse forward %s: %v", target.Address(), err)
+		return
+	}
+	defer stream.Close()
+	if err := cmd.WriteForward(stream, target); err != nil {
+		c.logger.Errorf("reverse forward %s: %v", target.Address(), err)
+		return
+	}
+	if err := cmd.ReadForwardReply(stream); err != nil {
+		c.logger.Errorf("reverse forward %s: %v", target.Address(), err)
+		return
+	}
+	go io.Copy(stream, conn)
+	io.Copy(conn, stream)
+}
@@ -1,72 +1,334 @@
-package main
-
-import (
-	"context"
-	"net"
-	"time"
-
-	"github.com/armon/go-socks5"
-	"github.com/hashicorp/yamux"
-	"github.com/howmp/reality"
-	"github.com/howmp/reality/cmd"
-	"github.com/sirupsen/logrus"
-)
-
-func main() {
-	config, err := reality.UnmarshalClientConfig(cmd.ConfigDataPlaceholder)
-	if err != nil {
-		println(err.Error())
-		return
-	}
-	logger := reality.GetLogger(config.Debug)
-	logger.Infof("server addr: %s, sni: %s", config.ServerAddr, config.SNI)
-
-	socksServer, err := socks5.New(&socks5.Config{})
-	if err != nil {
-		logger.Fatalln(err)
-	}
-	c := client{logger: logger, config: config, socksServer: socksServer}
-	for {
-		err = c.serve()
-		if err != nil {
-			logger.Errorf("serve: %v", err)
-		}
-		logger.Infoln("sleep 5s")
-		time.Sleep(time.Second * 5)
-
-	}
-}
-
-type client struct {
-	logger      logrus.FieldLogger
-	config      *reality.ClientConfig
-	socksServer *socks5.Server
-}
-
-func (c *client) serve() error {
-	c.logger.Infoln("try connect to server")
-	client, err := reality.NewClient(context.Background(), c.config)
-	if err != nil {
-		return err
-	}
-	c.logger.Infoln("server connected")
-	defer client.Close()
-	session, err := yamux.Client(client, nil)
-	if err != nil {
-		return err
-	}
-	defer session.Close()
-	for {
-		stream, err := session.Accept()
-		if err != nil {
-			return err
-		}
-		c.logger.Infof("new client %s", stream.RemoteAddr())
-		go c.handleStream(stream)
-	}
-}
-
-func (c *client) handleStream(conn net.Conn) {
-	defer conn.Close()
-	c.socksServer.ServeConn(conn)
-}
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/howmp/reality"
+	"github.com/howmp/reality/cmd"
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	config, err := reality.UnmarshalClientConfig(cmd.ConfigDataPlaceholder)
+	if err != nil {
+		println(err.Error())
+		return
+	}
+	var logOptions cmd.LogOptions
+	logOptions.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+	logger, closer, err := logOptions.NewLogger(config.Debug)
+	if err != nil {
+		println(err.Error())
+		return
+	}
+	if closer != nil {
+		defer closer.Close()
+		// Fatal直接退出不执行defer，退出前也关闭日志文件
+		logrus.RegisterExitHandler(func() { closer.Close() })
+	}
+	config.Logger = logger
+	config.UnsafeLogKeys = config.UnsafeLogKeys || logOptions.UnsafeKeys
+	logger.Infof("server addr: %s, sni: %s, endpoints: %d", config.ServerAddr, config.SNI, len(config.Endpoints))
+
+	c, err := newClient(config, logger)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	go c.reportLoop()
+	go c.serveForever()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	logger.Infof("received %s, exit", <-sig)
+}
+
+// serveForever 会话断开后按重连间隔重新连接服务端
+func (c *client) serveForever() {
+	for {
+		err := c.serve()
+		if err == nil {
+			// 服务端即将关闭，立即连接其他地址
+			continue
+		}
+		c.logger.Errorf("serve: %v", err)
+		c.backoff.Min = c.reconnectInterval()
+		interval := c.backoff.Next()
+		c.logger.Infof("sleep %s", interval)
+		time.Sleep(interval)
+	}
+}
+
+type client struct {
+	logger      *logrus.Logger
+	logLevel    logrus.Level // 命令行指定的日志级别，策略未指定级别时使用
+	config      *reality.ClientConfig
+	session     cmd.Mux
+	goaway      chan struct{} // 收到服务端关闭通知时关闭
+	sessionLock sync.Mutex
+	connector   *cmd.Connector
+	backoff     *cmd.Backoff
+	reports     chan reportItem
+	socksLogger *log.Logger // go-socks5的错误写入logger
+
+	// 以下为运行时策略，服务端下发后在进程生命周期内保持
+	rules           *cmd.RuleSet
+	resolver        *cmd.Resolver
+	dns             *cmd.DNSForwarder
+	upload          *cmd.Limiter
+	download        *cmd.Limiter
+	reconnectSecond uint32
+	audit           atomic.Bool                // 服务端开启审计时上报流的审计信息
+	forwards        map[string]*reverseForward // 按监听地址
+	forwardsLock    sync.Mutex
+	policyLock      sync.Mutex // 策略整体校验后一次替换
+}
+
+// newClient 创建客户端并应用内嵌配置中的默认策略，logger的当前级别作为策略未指定级别时的默认值
+func newClient(config *reality.ClientConfig, logger *logrus.Logger) (*client, error) {
+	c := &client{
+		logger:    logger,
+		logLevel:  logger.GetLevel(),
+		config:    config,
+		resolver:  &cmd.Resolver{},
+		upload:    cmd.NewLimiter(0),
+		download:  cmd.NewLimiter(0),
+		connector: &cmd.Connector{Config: config, Logger: logger},
+		backoff:   &cmd.Backoff{Max: cmd.DefaultReconnectMax},
+		reports:   make(chan reportItem, reportQueueSize),
+		// go-socks5默认写入标准输出，改为写入logger以使用日志文件和格式
+		socksLogger: log.New(logger.WriterLevel(logrus.ErrorLevel), "", 0),
+	}
+	c.rules = cmd.NewRuleSet(nil, c.onDeny)
+	c.dns = cmd.NewDNSForwarder(c.resolver)
+	if err := c.applyPolicy(&reality.ClientPolicy{}); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// serve 连接服务端并处理流，会话断开时返回错误，服务端通知即将关闭时返回nil
+func (c *client) serve() error {
+	c.logger.Infoln("try connect to server")
+	client, endpoint, err := c.connector.Connect(context.Background())
+	if err != nil {
+		return err
+	}
+	c.logger.Infof("server %s connected", endpoint)
+	session, err := c.newSession(client)
+	if err != nil {
+		client.Close()
+		return err
+	}
+	c.backoff.Reset()
+	goaway := make(chan struct{})
+	c.sessionLock.Lock()
+	c.session, c.goaway = session, goaway
+	c.sessionLock.Unlock()
+	accepted := make(chan error, 1)
+	go func() {
+		accepted <- c.acceptStreams(session)
+		session.Close()
+		client.Close()
+	}()
+	select {
+	case err := <-accepted:
+		return err
+	case <-goaway:
+		// 旧会话上已有的流继续完成，由服务端在流结束后关闭
+		c.logger.Infof("server %s going away, reconnect", endpoint)
+		c.connector.Skip()
+		return nil
+	}
+}
+
+// onGoaway 通知serve连接其他服务端，只处理当前会话的通知
+func (c *client) onGoaway(session cmd.Mux) {
+	c.sessionLock.Lock()
+	defer c.sessionLock.Unlock()
+	if c.session != session {
+		return
+	}
+	select {
+	case <-c.goaway:
+	default:
+		close(c.goaway)
+	}
+}
+
+func (c *client) acceptStreams(session cmd.Mux) error {
+	limiter := cmd.NewStreamLimiter(c.config.Mux)
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return err
+		}
+		if !limiter.Acquire() {
+			c.logger.Warnf("too many streams, close %s", stream.RemoteAddr())
+			stream.Close()
+			continue
+		}
+		c.logger.Infof("new client %s", stream.RemoteAddr())
+		go func() {
+			defer limiter.Release()
+			c.handleStream(session, stream)
+		}()
+	}
+}
+
+// newSession 按多路复用模式在连接上建立会话，none模式下每个流单独连接服务端
+func (c *client) newSession(conn net.Conn) (cmd.Mux, error) {
+	if c.config.Mux.Multiplexed() {
+		session, err := cmd.NewMuxSession(conn, c.config.Mux, true)
+		if err != nil {
+			return nil, fmt.Errorf("yamux: %w", err)
+		}
+		return session, nil
+	}
+	sid, err := cmd.NewSessionID()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.WriteHello(conn, cmd.HelloSession, sid); err != nil {
+		return nil, fmt.Errorf("hello: %w", err)
+	}
+	dial := func(kind byte) (net.Conn, error) {
+		conn, _, err := c.connector.Connect(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.WriteHello(conn, kind, sid); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	return cmd.NewDialMux(conn, dial, c.config.Mux.IdleConnCount(), c.config.Mux), nil
+}
+
+func (c *client) handleStream(session cmd.Mux, conn net.Conn) {
+	defer conn.Close()
+	streamType, err := cmd.ReadStreamType(conn)
+	if err != nil {
+		c.logger.Errorf("read stream type: %v", err)
+		return
+	}
+	if streamType == cmd.StreamControl {
+		c.handleControl(session, conn)
+		return
+	}
+	id, err := cmd.ReadStreamID(conn)
+	if err != nil {
+		c.logger.Errorf("read stream id: %v", err)
+		return
+	}
+	entry := newAuditEntry(id, streamType)
+	limited := cmd.LimitConn(&auditConn{Conn: conn, entry: entry}, []*cmd.Limiter{c.upload}, []*cmd.Limiter{c.download})
+	switch streamType {
+	case cmd.StreamSocks:
+		err = c.serveSocks(limited, entry)
+	case cmd.StreamUDP:
+		if err = cmd.ServeUDP(limited, c.resolver, c.rules, cmd.DefaultUDPTimeout, entry.udpDest, c.logger); err != nil {
+			c.logger.Errorf("udp relay: %v", err)
+		}
+	case cmd.StreamForward:
+		err = c.handleForward(limited, entry)
+	case cmd.StreamDNS:
+		// DNS查询不记录审计
+		if err := c.dns.ServeStream(limited, c.logger); err != nil {
+			c.logger.Errorf("dns: %v", err)
+		}
+		return
+	default:
+		c.logger.Errorf("unknown stream type %d", streamType)
+		return
+	}
+	if c.audit.Load() {
+		c.report(cmd.MessageAudit, entry.finish(err))
+	}
+}
+
+func (c *client) serveSocks(conn net.Conn, entry *auditEntry) error {
+	server, err := c.newSocksServer(entry)
+	if err != nil {
+		return err
+	}
+	return server.ServeConn(conn)
+}
+
+// onDeny 目标被规则拒绝，记录日志并上报服务端
+func (c *client) onDeny(req *socks5.Request, rule *cmd.Rule) {
+	c.logger.Warnf("deny %s by rule %q", req.DestAddr, rule)
+	c.report(cmd.MessageDeny, &cmd.DenyMessage{Dest: req.DestAddr.String(), Rule: rule.String()})
+}
+
+// reportQueueSize 待上报消息的队列长度，队列满时丢弃新消息
+const reportQueueSize = 1024
+
+type reportItem struct {
+	messageType byte
+	v           interface{}
+}
+
+// report 将消息加入上报队列，不阻塞
+func (c *client) report(messageType byte, v interface{}) {
+	select {
+	case c.reports <- reportItem{messageType, v}:
+	default:
+		c.logger.Warnf("report queue full, drop message type %d", messageType)
+	}
+}
+
+// reportLoop 复用一个上报流依次发送消息，写入失败时重新打开流重试一次
+func (c *client) reportLoop() {
+	var stream net.Conn
+	for item := range c.reports {
+		for retry := 0; retry < 2; retry++ {
+			if stream == nil {
+				s, err := c.openStream(cmd.StreamReport)
+				if err != nil {
+					c.logger.Errorf("report: %v", err)
+					break
+				}
+				stream = s
+			}
+			if err := cmd.WriteMessage(stream, item.messageType, item.v); err != nil {
+				c.logger.Debugf("report: %v, reopen", err)
+				stream.Close()
+				stream = nil
+				continue
+			}
+			break
+		}
+	}
+}
+
+// openStream 在当前会话上打开流并发送流类型
+func (c *client) openStream(streamType byte) (net.Conn, error) {
+	c.sessionLock.Lock()
+	session := c.session
+	c.sessionLock.Unlock()
+	if session == nil {
+		return nil, errors.New("session not open")
+	}
+	stream, err := session.Open()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.WriteStreamType(stream, streamType); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
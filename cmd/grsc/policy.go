@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/howmp/reality"
+	"github.com/howmp/reality/cmd"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultReconnectSecond = 5
+
+// handleControl 处理服务端下发的控制消息，处理后回复确认
+func (c *client) handleControl(session cmd.Mux, conn net.Conn) {
+	messageType, data, err := cmd.ReadMessage(conn)
+	if err != nil {
+		c.logger.Errorf("read control message: %v", err)
+		return
+	}
+	var ack cmd.AckMessage
+	switch messageType {
+	case cmd.MessagePolicy:
+		var policy reality.ClientPolicy
+		if err = json.Unmarshal(data, &policy); err == nil {
+			err = c.applyPolicy(&policy)
+		}
+	case cmd.MessageGoaway:
+		defer c.onGoaway(session)
+	default:
+		err = fmt.Errorf("unknown message type %d", messageType)
+	}
+	if err != nil {
+		c.logger.Errorf("control message: %v", err)
+		ack.Error = err.Error()
+	}
+	if err := cmd.WriteMessage(conn, cmd.MessageAck, &ack); err != nil {
+		c.logger.Errorf("write ack: %v", err)
+	}
+}
+
+// applyPolicy 应用运行时策略，策略中为空的字段使用内嵌配置中的默认值，
+// 全部校验通过并打开反向转发的监听后才替换，出错时保持原策略
+func (c *client) applyPolicy(policy *reality.ClientPolicy) error {
+	c.policyLock.Lock()
+	defer c.policyLock.Unlock()
+	ruleTexts := c.config.Rules
+	if policy.Rules != nil {
+		ruleTexts = policy.Rules
+	}
+	rules, err := cmd.ParseRules(ruleTexts)
+	if err != nil {
+		return err
+	}
+	level := c.logLevel
+	if policy.LogLevel != "" {
+		if level, err = logrus.ParseLevel(policy.LogLevel); err != nil {
+			return err
+		}
+	}
+	if err := validateDNS(policy); err != nil {
+		return err
+	}
+	reconnectSecond := policy.ReconnectSecond
+	if reconnectSecond == 0 {
+		reconnectSecond = defaultReconnectSecond
+	}
+	forwards, err := c.prepareForwards(policy.Forwards)
+	if err != nil {
+		return err
+	}
+
+	c.rules.SetRules(rules)
+	c.resolver.SetServer(policy.DNSServer)
+	c.resolver.SetUpstreams(policy.DNSUpstreams)
+	c.dns.FlushCache()
+	c.upload.SetRate(policy.UploadLimit)
+	c.download.SetRate(policy.DownloadLimit)
+	atomic.StoreUint32(&c.reconnectSecond, reconnectSecond)
+	c.audit.Store(policy.Audit)
+	c.logger.SetLevel(level)
+	c.applyForwards(forwards)
+	c.logger.Infof(
+		"policy applied, rules: %d, dns: %q, dns upstreams: %d, upload: %d, download: %d, reconnect: %ds, log level: %s, forwards: %d, audit: %t",
+		len(rules), policy.DNSServer, len(policy.DNSUpstreams), policy.UploadLimit, policy.DownloadLimit, reconnectSecond, level, len(policy.Forwards), policy.Audit,
+	)
+	return nil
+}
+
+// validateDNS 检查DNS服务器地址为host:port
+func validateDNS(policy *reality.ClientPolicy) error {
+	if policy.DNSServer != "" {
+		if _, _, err := net.SplitHostPort(policy.DNSServer); err != nil {
+			return fmt.Errorf("dns server %s: %w", policy.DNSServer, err)
+		}
+	}
+	for suffix, server := range policy.DNSUpstreams {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return fmt.Errorf("dns upstream %s %s: %w", suffix, server, err)
+		}
+	}
+	return nil
+}
+
+func (c *client) reconnectInterval() time.Duration {
+	return time.Duration(atomic.LoadUint32(&c.reconnectSecond)) * time.Second
+}
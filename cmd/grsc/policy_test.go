@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/howmp/reality"
+	"github.com/howmp/reality/cmd"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestClient(t *testing.T) *client {
+	t.Helper()
+	logger := logrus.New()
+	c, err := newClient(&reality.ClientConfig{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.applyForwards(&forwardPlan{}) })
+	return c
+}
+
+// newTestSession 返回服务端侧的会话，客户端侧由c处理流
+func newTestSession(t *testing.T, c *client) *yamux.Session {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	server, err := yamux.Server(serverConn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := yamux.Client(clientConn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		server.Close()
+		session.Close()
+	})
+	go c.acceptStreams(session)
+	return server
+}
+
+// pushPolicy 模拟grss下发策略，返回客户端确认中的错误
+func pushPolicy(t *testing.T, session *yamux.Session, policy *reality.ClientPolicy) string {
+	t.Helper()
+	stream, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(time.Second))
+	if err := cmd.WriteStreamType(stream, cmd.StreamControl); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.WriteMessage(stream, cmd.MessagePolicy, policy); err != nil {
+		t.Fatal(err)
+	}
+	messageType, data, err := cmd.ReadMessage(stream)
+	if err != nil || messageType != cmd.MessageAck {
+		t.Fatalf("read ack: %d %v", messageType, err)
+	}
+	var ack cmd.AckMessage
+	if err := json.Unmarshal(data, &ack); err != nil {
+		t.Fatal(err)
+	}
+	return ack.Error
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestPolicyRoundTrip(t *testing.T) {
+	c := newTestClient(t)
+	forward := freeAddr(t)
+	policy := &reality.ClientPolicy{
+		Rules:         []string{"deny 10.0.0.0/8"},
+		DNSServer:     "10.0.0.53:53",
+		UploadLimit:   1024,
+		DownloadLimit: 2048,
+		LogLevel:      "debug",
+		Forwards:      []*reality.ClientForward{{Listen: forward, Target: "10.0.0.1:80"}},
+	}
+	if ack := pushPolicy(t, newTestSession(t, c), policy); ack != "" {
+		t.Fatal(ack)
+	}
+	if _, allow := c.rules.Check("", net.ParseIP("10.1.1.1"), 80); allow {
+		t.Fatal("rules not applied")
+	}
+	if c.resolver.Server() != "10.0.0.53:53" || c.upload.Rate() != 1024 || c.download.Rate() != 2048 {
+		t.Fatal("dns or limits not applied")
+	}
+	if c.logger.GetLevel() != logrus.DebugLevel {
+		t.Fatalf("log level %s", c.logger.GetLevel())
+	}
+	conn, err := net.Dial("tcp", forward)
+	if err != nil {
+		t.Fatalf("reverse forward not listening: %v", err)
+	}
+	conn.Close()
+
+	// 重连后策略保持，直到服务端下发新策略
+	if _, allow := c.rules.Check("", net.ParseIP("10.1.1.1"), 80); allow {
+		t.Fatal("rules lost")
+	}
+	if ack := pushPolicy(t, newTestSession(t, c), &reality.ClientPolicy{}); ack != "" {
+		t.Fatal(ack)
+	}
+	if _, allow := c.rules.Check("", net.ParseIP("10.1.1.1"), 80); !allow {
+		t.Fatal("default rules not restored")
+	}
+	if c.logger.GetLevel() != logrus.InfoLevel {
+		t.Fatalf("log level %s", c.logger.GetLevel())
+	}
+	if conn, err := net.Dial("tcp", forward); err == nil {
+		conn.Close()
+		t.Fatal("removed reverse forward still listening")
+	}
+}
+
+// TestPolicyAtomic 策略中任一部分无效时保持原策略
+func TestPolicyAtomic(t *testing.T) {
+	c := newTestClient(t)
+	forward := freeAddr(t)
+	if err := c.applyPolicy(&reality.ClientPolicy{
+		Rules:    []string{"deny 10.0.0.0/8"},
+		Forwards: []*reality.ClientForward{{Listen: forward, Target: "10.0.0.1:80"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	for _, policy := range []*reality.ClientPolicy{
+		{LogLevel: "debug", Forwards: []*reality.ClientForward{{Listen: busy.Addr().String(), Target: "10.0.0.2:80"}}},
+		{LogLevel: "debug", Forwards: []*reality.ClientForward{{Listen: forward, Target: "bad"}}},
+		{LogLevel: "debug", DNSServer: "10.0.0.53"},
+		{LogLevel: "debug", UploadLimit: 1, Rules: []string{"bad"}},
+	} {
+		if ack := pushPolicy(t, newTestSession(t, c), policy); ack == "" {
+			t.Fatalf("policy %+v accepted", policy)
+		}
+		if _, allow := c.rules.Check("", net.ParseIP("10.1.1.1"), 80); allow {
+			t.Fatal("rules changed")
+		}
+		if c.logger.GetLevel() != logrus.InfoLevel || c.upload.Rate() != 0 {
+			t.Fatal("policy partially applied")
+		}
+		conn, err := net.Dial("tcp", forward)
+		if err != nil {
+			t.Fatalf("reverse forward closed: %v", err)
+		}
+		conn.Close()
+	}
+
+	// 只改变目标时沿用已有的监听
+	if err := c.applyPolicy(&reality.ClientPolicy{
+		Forwards: []*reality.ClientForward{{Listen: forward, Target: "10.0.0.3:80"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if target := c.forwards[forward].target.Load().Address(); target != "10.0.0.3:80" {
+		t.Fatalf("target %s", target)
+	}
+}
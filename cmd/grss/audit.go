@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/howmp/reality"
+	"github.com/howmp/reality/cmd"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	auditGrace             = 10 * time.Second // 服务端流结束后等待客户端上报的时间
+	defaultAuditMaxSizeMB  = 100
+	defaultAuditMaxBackups = 5
+)
+
+var streamTypeNames = map[byte]string{
+	cmd.StreamSocks:   "socks",
+	cmd.StreamUDP:     "udp",
+	cmd.StreamForward: "forward",
+	cmd.StreamDNS:     "dns",
+}
+
+// auditRecord 审计日志中的一条记录，上行为用户端到目标的方向
+type auditRecord struct {
+	Time       time.Time `json:"time"`
+	User       string    `json:"user"`
+	Client     byte      `json:"client"`
+	Type       string    `json:"type"`
+	Dest       string    `json:"dest,omitempty"`
+	Resolved   string    `json:"resolved,omitempty"`
+	Upload     int64     `json:"upload"`
+	Download   int64     `json:"download"`
+	DurationMS int64     `json:"duration_ms"`
+	Result     string    `json:"result"`
+}
+
+type auditPending struct {
+	user       string
+	client     byte
+	streamType byte
+	start      time.Time
+
+	// 服务端侧流结束后设置
+	ended    bool
+	upload   int64
+	download int64
+	duration time.Duration
+}
+
+// noReport 未收到客户端上报时按服务端统计记录
+func (p *auditPending) noReport() *auditRecord {
+	return &auditRecord{
+		Time:       p.start,
+		User:       p.user,
+		Client:     p.client,
+		Type:       streamTypeNames[p.streamType],
+		Upload:     p.upload,
+		Download:   p.download,
+		DurationMS: p.duration.Milliseconds(),
+		Result:     "no report",
+	}
+}
+
+// auditor 为服务端转发给客户端的流分配ID，收到客户端上报后写入审计日志，
+// 超时未收到上报时按服务端统计的字节数写入
+type auditor struct {
+	writer io.Writer // 为nil时不记录
+	logger logrus.FieldLogger
+	grace  time.Duration
+	next   uint64
+
+	lock    sync.Mutex
+	pending map[uint64]*auditPending
+}
+
+func newAuditor(c *reality.AuditConfig, logger logrus.FieldLogger) (*auditor, error) {
+	a := &auditor{logger: logger, grace: auditGrace, pending: make(map[uint64]*auditPending)}
+	if c == nil {
+		return a, nil
+	}
+	maxSize, maxBackups := c.MaxSizeMB, c.MaxBackups
+	if maxSize == 0 {
+		maxSize = defaultAuditMaxSizeMB
+	}
+	if maxBackups == 0 {
+		maxBackups = defaultAuditMaxBackups
+	}
+	w, err := cmd.NewRotatingWriter(c.File, int64(maxSize)<<20, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	a.writer = w
+	return a, nil
+}
+
+// enabled 是否记录审计日志
+func (a *auditor) enabled() bool {
+	return a != nil && a.writer != nil
+}
+
+// begin 返回流ID，DNS查询不记录
+func (a *auditor) begin(user string, client byte, streamType byte) uint64 {
+	id := atomic.AddUint64(&a.next, 1)
+	if a.writer == nil || streamType == cmd.StreamDNS {
+		return id
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.pending[id] = &auditPending{user: user, client: client, streamType: streamType, start: time.Now()}
+	return id
+}
+
+// end 服务端侧流结束，upload、download为服务端统计的字节数
+func (a *auditor) end(id uint64, upload, download int64) {
+	if a.writer == nil {
+		return
+	}
+	a.lock.Lock()
+	p, ok := a.pending[id]
+	if ok {
+		p.ended, p.upload, p.download, p.duration = true, upload, download, time.Since(p.start)
+	}
+	a.lock.Unlock()
+	if !ok {
+		return
+	}
+	time.AfterFunc(a.grace, func() {
+		if p := a.take(id, nil); p != nil {
+			a.write(p.noReport())
+		}
+	})
+}
+
+// report 处理客户端上报，只接受发给该客户端的流
+func (a *auditor) report(client byte, m *cmd.AuditMessage) {
+	if a.writer == nil {
+		return
+	}
+	p := a.take(m.ID, &client)
+	if p == nil {
+		a.logger.Debugf("client(id:%d) audit report for unknown stream %d", client, m.ID)
+		return
+	}
+	a.write(&auditRecord{
+		Time:       p.start,
+		User:       p.user,
+		Client:     p.client,
+		Type:       streamTypeNames[p.streamType],
+		Dest:       m.Dest,
+		Resolved:   m.Resolved,
+		Upload:     m.Upload,
+		Download:   m.Download,
+		DurationMS: m.DurationMS,
+		Result:     m.Result,
+	})
+}
+
+// take 取出并删除等待上报的流，client不为nil时必须匹配
+func (a *auditor) take(id uint64, client *byte) *auditPending {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	p, ok := a.pending[id]
+	if !ok || (client != nil && p.client != *client) {
+		return nil
+	}
+	delete(a.pending, id)
+	return p
+}
+
+func (a *auditor) pendingCount() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return len(a.pending)
+}
+
+// close 写入已结束但未收到上报的流，丢弃未结束的流，之后的上报被忽略
+func (a *auditor) close() error {
+	a.lock.Lock()
+	pending := a.pending
+	a.pending = make(map[uint64]*auditPending)
+	a.lock.Unlock()
+	if a.writer == nil {
+		return nil
+	}
+	for _, p := range pending {
+		if p.ended {
+			a.write(p.noReport())
+		}
+	}
+	if c, ok := a.writer.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (a *auditor) write(r *auditRecord) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		a.logger.Errorf("audit: %v", err)
+		return
+	}
+	if _, err := a.writer.Write(append(data, '\n')); err != nil {
+		a.logger.Errorf("audit: %v", err)
+	}
+}
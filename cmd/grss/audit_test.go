@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/howmp/reality"
+	"github.com/howmp/reality/cmd"
+)
+
+func readAudit(t *testing.T, file string) []*auditRecord {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []*auditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		r := &auditRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestAuditor(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+	a, err := newAuditor(&reality.AuditConfig{File: file}, reality.GetLogger(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.grace = 50 * time.Millisecond
+
+	reported := a.begin("alice", 1, cmd.StreamSocks)
+	// 其他客户端不能上报该流
+	a.report(2, &cmd.AuditMessage{ID: reported, Dest: "evil:1", Result: "ok"})
+	a.report(1, &cmd.AuditMessage{ID: reported, Dest: "example.com:443", Resolved: "1.2.3.4:443", Result: "ok", Upload: 10, Download: 20, DurationMS: 5})
+	a.end(reported, 11, 21)
+
+	lost := a.begin("bob", 2, cmd.StreamForward)
+	a.end(lost, 3, 4)
+	a.begin("bob", 2, cmd.StreamDNS)
+	time.Sleep(200 * time.Millisecond)
+
+	records := readAudit(t, file)
+	if len(records) != 2 {
+		t.Fatalf("want 2 records, got %d", len(records))
+	}
+	r := records[0]
+	if r.User != "alice" || r.Client != 1 || r.Type != "socks" || r.Dest != "example.com:443" || r.Upload != 10 || r.Result != "ok" {
+		t.Fatalf("record %+v", r)
+	}
+	r = records[1]
+	if r.User != "bob" || r.Type != "forward" || r.Upload != 3 || r.Download != 4 || r.Result != "no report" {
+		t.Fatalf("record %+v", r)
+	}
+	if len(a.pending) != 0 {
+		t.Fatalf("pending %d", len(a.pending))
+	}
+}
+
+// TestAuditPolicy 开启审计时即使没有配置策略也下发审计标志，移除策略后仍保留
+func TestAuditPolicy(t *testing.T) {
+	sm := newTestSessionManager(reality.SessionPolicyReplace)
+	a, err := newAuditor(&reality.AuditConfig{File: filepath.Join(t.TempDir(), "audit.log")}, sm.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.audit = a
+	session := dialSession(t, sm, 1)
+	if p := receivePolicy(t, session, ""); !p.Audit {
+		t.Fatalf("policy %+v", p)
+	}
+	sm.setClientPolicies(map[byte]*reality.ClientPolicy{1: {UploadLimit: 1024}})
+	if p := receivePolicy(t, session, ""); !p.Audit || p.UploadLimit != 1024 {
+		t.Fatalf("changed policy %+v", p)
+	}
+	if sm.clientPolicies[1].Audit {
+		t.Fatal("configured policy should not be modified")
+	}
+	sm.setClientPolicies(nil)
+	if p := receivePolicy(t, session, ""); !p.Audit || p.UploadLimit != 0 {
+		t.Fatalf("removed policy %+v", p)
+	}
+	// 审计标志只能由服务端设置
+	config, err := reality.NewServerConfig("example.com:443", "127.0.0.1:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ClientPolicies = map[byte]*reality.ClientPolicy{1: {Audit: true}}
+	if err := config.Validate(); err == nil {
+		t.Fatal("audit in client policy should be invalid")
+	}
+}
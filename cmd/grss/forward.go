@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/howmp/reality"
+	"github.com/howmp/reality/cmd"
+)
+
+const dialTimeout = 10 * time.Second
+
+// serveForward 服务端端口转发，监听本地端口，每个连接经客户端连接内网目标
+func (s *Server) serveForward(f *reality.ForwardConfig) {
+	target, err := cmd.ParseAddr(f.Target)
+	if err != nil {
+		s.logger.Errorf("forward %s: %v", f.Listen, err)
+		return
+	}
+	l, err := net.Listen("tcp", f.Listen)
+	if err != nil {
+		s.logger.Errorf("forward listen: %v", err)
+		return
+	}
+	if !s.addListeners(l) {
+		return
+	}
+	s.logger.Infof("forward %s -> client(id:%d) %s", f.Listen, f.Client, f.Target)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !s.isClosing() {
+				s.logger.Errorf("forward accept: %v", err)
+			}
+			return
+		}
+		go s.handleForward(conn, byte(f.Client), target)
+	}
+}
+
+func (s *Server) handleForward(conn net.Conn, id byte, target *socks5.AddrSpec) {
+	defer s.sm.trackStream()()
+	defer conn.Close()
+	stream, err := s.sm.openClientSessionStream(id)
+	if err != nil {
+		s.logger.Errorf("open client(id:%d) session stream: %v", id, err)
+		return
+	}
+	defer stream.Close()
+	if err := cmd.WriteStreamType(stream, cmd.StreamForward); err != nil {
+		s.logger.Errorf("client(id:%d) forward %s: %v", id, target.Address(), err)
+		return
+	}
+	// 服务端端口转发不属于用户，只统计审计使用的字节数
+	counted := &countedConn{Conn: conn}
+	sid := s.sm.audit.begin("", id, cmd.StreamForward)
+	defer func() { s.sm.audit.end(sid, counted.uploaded(), counted.downloaded()) }()
+	if err := cmd.WriteStreamID(stream, sid); err != nil {
+		s.logger.Errorf("client(id:%d) forward %s: %v", id, target.Address(), err)
+		return
+	}
+	if err := cmd.WriteForward(stream, target); err != nil {
+		s.logger.Errorf("client(id:%d) forward %s: %v", id, target.Address(), err)
+		return
+	}
+	if err := cmd.ReadForwardReply(stream); err != nil {
+		s.logger.Errorf("client(id:%d) forward %s: %v", id, target.Address(), err)
+		return
+	}
+	s.logger.Infof("client(id:%d) forward %s from %s", id, target.Address(), conn.RemoteAddr())
+	limited := s.sm.limits.limitUser(counted, "", id)
+	go io.Copy(stream, limited)
+	io.Copy(limited, stream)
+}
+
+// handleClientForward 客户端反向端口转发，只允许连接该客户端策略中配置的目标
+func (s *sessionManager) handleClientForward(id byte, stream net.Conn) {
+	defer s.trackStream()()
+	addr, err := cmd.ReadAddr(stream)
+	if err != nil {
+		s.logger.Errorf("client(id:%d) forward read addr: %v", id, err)
+		return
+	}
+	if !s.forwardAllowed(id, addr.Address()) {
+		s.logger.Warnf("client(id:%d) forward %s not allowed", id, addr.Address())
+		stream.Write([]byte{cmd.SocksReplyRuleFailure})
+		return
+	}
+	target, err := net.DialTimeout("tcp", addr.Address(), dialTimeout)
+	if err != nil {
+		s.logger.Errorf("client(id:%d) forward %s: %v", id, addr.Address(), err)
+		stream.Write([]byte{cmd.SocksReplyHostUnreachable})
+		return
+	}
+	defer target.Close()
+	if _, err := stream.Write([]byte{cmd.SocksReplySuccess}); err != nil {
+		return
+	}
+	s.logger.Infof("client(id:%d) reverse forward %s", id, addr.Address())
+	limited := s.limits.limitClient(stream, id)
+	go io.Copy(target, limited)
+	io.Copy(limited, target)
+}
+
+func (s *sessionManager) forwardAllowed(id byte, target string) bool {
+	p := s.clientPolicy(id)
+	if p == nil {
+		return false
+	}
+	for _, f := range p.Forwards {
+		if addr, err := cmd.ParseAddr(f.Target); err == nil && addr.Address() == target {
+			return true
+		}
+	}
+	return false
+}
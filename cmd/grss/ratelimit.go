@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/howmp/reality"
+	"github.com/howmp/reality/cmd"
+	"github.com/sirupsen/logrus"
+)
+
+// rateStatsInterval 输出限速统计的间隔
+const rateStatsInterval = time.Minute
+
+// limiterPair 一组上下行限速器
+type limiterPair struct {
+	upload   *cmd.Limiter
+	download *cmd.Limiter
+
+	// 上次输出统计时的计数
+	lastUpload, lastDownload         int64
+	lastUploadWait, lastDownloadWait time.Duration
+}
+
+func newLimiterPair(r *reality.RateLimit) *limiterPair {
+	p := &limiterPair{upload: cmd.NewLimiter(0), download: cmd.NewLimiter(0)}
+	p.set(r)
+	return p
+}
+
+// set r为nil时取消限速
+func (p *limiterPair) set(r *reality.RateLimit) {
+	if r == nil {
+		r = &reality.RateLimit{}
+	}
+	p.upload.SetRate(r.Upload)
+	p.download.SetRate(r.Download)
+}
+
+// rateLimits 服务端限速器，修改配置时只修改速率，已有连接立即生效
+type rateLimits struct {
+	lock    sync.Mutex
+	global  *limiterPair
+	clients map[byte]*limiterPair
+	users   map[string]*limiterPair
+}
+
+func newRateLimits(c *reality.RateLimitConfig) *rateLimits {
+	r := &rateLimits{
+		global:  newLimiterPair(nil),
+		clients: make(map[byte]*limiterPair),
+		users:   make(map[string]*limiterPair),
+	}
+	r.set(c)
+	return r
+}
+
+// set 应用新配置，配置中移除的客户端和用户取消限速
+func (r *rateLimits) set(c *reality.RateLimitConfig) {
+	if c == nil {
+		c = &reality.RateLimitConfig{}
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.global.set(c.Global)
+	for id, p := range r.clients {
+		p.set(c.Clients[id])
+	}
+	for id, limit := range c.Clients {
+		if _, ok := r.clients[id]; !ok {
+			r.clients[id] = newLimiterPair(limit)
+		}
+	}
+	for name, p := range r.users {
+		p.set(c.Users[name])
+	}
+	for name, limit := range c.Users {
+		if _, ok := r.users[name]; !ok {
+			r.users[name] = newLimiterPair(limit)
+		}
+	}
+}
+
+func (r *rateLimits) client(id byte) *limiterPair {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	p, ok := r.clients[id]
+	if !ok {
+		p = newLimiterPair(nil)
+		r.clients[id] = p
+	}
+	return p
+}
+
+// user name为空时返回nil，未认证的用户名不创建限速器
+func (r *rateLimits) user(name string) *limiterPair {
+	if name == "" {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	p, ok := r.users[name]
+	if !ok {
+		p = newLimiterPair(nil)
+		r.users[name] = p
+	}
+	return p
+}
+
+// limitUser 包装用户侧连接，读为上行，写为下行
+func (r *rateLimits) limitUser(conn net.Conn, name string, id byte) net.Conn {
+	pairs := []*limiterPair{r.global, r.client(id)}
+	if p := r.user(name); p != nil {
+		pairs = append(pairs, p)
+	}
+	var upload, download []*cmd.Limiter
+	for _, p := range pairs {
+		upload = append(upload, p.upload)
+		download = append(download, p.download)
+	}
+	return cmd.LimitConn(conn, upload, download)
+}
+
+// limitClient 包装客户端侧连接，读为下行，写为上行
+func (r *rateLimits) limitClient(conn net.Conn, id byte) net.Conn {
+	client := r.client(id)
+	return cmd.LimitConn(conn,
+		[]*cmd.Limiter{r.global.download, client.download},
+		[]*cmd.Limiter{r.global.upload, client.upload})
+}
+
+// logStats 定期输出有流量的限速器在统计周期内的平均速率和等待时间
+func (r *rateLimits) logStats(logger logrus.FieldLogger) {
+	for range time.Tick(rateStatsInterval) {
+		r.lock.Lock()
+		pairs := map[string]*limiterPair{"global": r.global}
+		for id, p := range r.clients {
+			pairs[fmt.Sprintf("client(id:%d)", id)] = p
+		}
+		for name, p := range r.users {
+			pairs[fmt.Sprintf("user(%s)", name)] = p
+		}
+		r.lock.Unlock()
+		names := make([]string, 0, len(pairs))
+		for name := range pairs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if line := pairs[name].stats(rateStatsInterval); line != "" {
+				logger.Infof("rate %s %s", name, line)
+			}
+		}
+	}
+}
+
+// stats 返回统计周期内的速率，没有流量时返回空
+func (p *limiterPair) stats(interval time.Duration) string {
+	upload, uploadWait := p.upload.Stats()
+	download, downloadWait := p.download.Stats()
+	up, down := upload-p.lastUpload, download-p.lastDownload
+	upWait, downWait := uploadWait-p.lastUploadWait, downloadWait-p.lastDownloadWait
+	p.lastUpload, p.lastDownload = upload, download
+	p.lastUploadWait, p.lastDownloadWait = uploadWait, downloadWait
+	if up == 0 && down == 0 {
+		return ""
+	}
+	seconds := int64(interval / time.Second)
+	return fmt.Sprintf("upload %d/%d B/s throttled %s, download %d/%d B/s throttled %s",
+		up/seconds, p.upload.Rate(), upWait.Round(time.Millisecond),
+		down/seconds, p.download.Rate(), downWait.Round(time.Millisecond))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/howmp/reality"
+)
+
+func TestRateLimits(t *testing.T) {
+	r := newRateLimits(&reality.RateLimitConfig{
+		Global:  &reality.RateLimit{Upload: 1000},
+		Clients: map[byte]*reality.RateLimit{1: {Download: 2000}},
+		Users:   map[string]*reality.RateLimit{"alice": {Upload: 3000, Download: 4000}},
+	})
+	client, alice := r.client(1), r.user("alice")
+	if r.global.upload.Rate() != 1000 || client.download.Rate() != 2000 || alice.upload.Rate() != 3000 {
+		t.Fatal("limits not applied")
+	}
+	if r.user("") != nil {
+		t.Fatal("empty user should not be limited")
+	}
+	if r.user("bob").upload.Rate() != 0 || r.client(2).download.Rate() != 0 {
+		t.Fatal("unconfigured should not be limited")
+	}
+
+	// 重新加载后已有限速器立即生效，移除的配置取消限速
+	r.set(&reality.RateLimitConfig{
+		Clients: map[byte]*reality.RateLimit{1: {Download: 5000}},
+		Users:   map[string]*reality.RateLimit{"bob": {Upload: 6000}},
+	})
+	if r.global.upload.Rate() != 0 || client.download.Rate() != 5000 || alice.upload.Rate() != 0 || r.user("bob").upload.Rate() != 6000 {
+		t.Fatal("reload not applied")
+	}
+	if err := (&reality.RateLimitConfig{Users: map[string]*reality.RateLimit{"bob": {Upload: -1}}}).Validate(); err == nil {
+		t.Fatal("negative limit should be invalid")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"reflect"
+
+	"github.com/howmp/reality"
+)
+
+// Reload 替换配置，之后的握手、认证和流使用新配置，已有会话在凭据仍有效时保留，
+// 监听地址、多路复用、流量统计、审计和端口转发需要重启才能生效，沿用原配置
+func (s *Server) Reload(config *reality.ServerConfig) {
+	old := s.currentConfig()
+	if config.Logger == nil {
+		config.Logger = old.Logger
+	}
+	s.keepRestartFields(old, config)
+
+	s.configLock.Lock()
+	s.config = config
+	s.configLock.Unlock()
+	// Serve按AllListeners的顺序加入reality监听
+	listeners := config.AllListeners()
+	s.lock.Lock()
+	i := 0
+	for _, l := range s.listeners {
+		if rl, ok := l.(*reality.Listener); ok && i < len(listeners) {
+			rl.SetConfig(config.ForListener(listeners[i]))
+			i++
+		}
+	}
+	s.lock.Unlock()
+
+	s.sm.setSessionPolicy(config.SessionPolicy, config.GroupStrategy)
+	s.sm.setClientPolicies(config.ClientPolicies)
+	s.sm.limits.set(config.RateLimits)
+	if old.PrivateKeyECDH != config.PrivateKeyECDH || old.PrivateKeySign != config.PrivateKeySign {
+		// 密钥变化后已有连接的身份无法再验证
+		s.logger.Warnf("private keys changed, close all sessions, clients need to be regenerated")
+		s.sm.closeSessions()
+		s.closeUsers(func(*userConn) bool { return true })
+		return
+	}
+	s.closeUsers(func(u *userConn) bool { return !credentialsValid(old, config, u.name, u.id) })
+}
+
+// keepRestartFields 需要重启才能生效的字段沿用原配置，有变化时提示
+func (s *Server) keepRestartFields(old, config *reality.ServerConfig) {
+	if config.ServerAddr != old.ServerAddr {
+		s.logger.Warnf("server_addr changed, restart to apply")
+		config.ServerAddr = old.ServerAddr
+	}
+	if !sameListens(config, old) {
+		s.logger.Warnf("listen addresses changed, restart to apply")
+		config.Listeners = old.Listeners
+	}
+	if !reflect.DeepEqual(config.Mux, old.Mux) {
+		s.logger.Warnf("mux changed, restart and regenerate clients to apply")
+		config.Mux = old.Mux
+	}
+	if !reflect.DeepEqual(config.Traffic, old.Traffic) {
+		s.logger.Warnf("traffic changed, restart to apply")
+		config.Traffic = old.Traffic
+	}
+	if !reflect.DeepEqual(config.Audit, old.Audit) {
+		s.logger.Warnf("audit changed, restart to apply")
+		config.Audit = old.Audit
+	}
+	if !reflect.DeepEqual(config.Forwards, old.Forwards) {
+		s.logger.Warnf("forwards changed, restart to apply")
+		config.Forwards = old.Forwards
+	}
+}
+
+// sameListens 额外监听的地址是否相同，模拟目标可以重新加载
+func sameListens(a, b *reality.ServerConfig) bool {
+	if len(a.Listeners) != len(b.Listeners) {
+		return false
+	}
+	for i := range a.Listeners {
+		if a.Listeners[i].Listen != b.Listeners[i].Listen {
+			return false
+		}
+	}
+	return true
+}
+
+// credentialsValid 用户端在旧配置下的认证在新配置下是否仍然有效
+func credentialsValid(old, config *reality.ServerConfig, name string, id byte) bool {
+	if len(config.Users) == 0 {
+		return true
+	}
+	if len(old.Users) == 0 {
+		// 之前未校验用户端身份
+		return false
+	}
+	o, u := old.User(name), config.User(name)
+	return o != nil && u != nil && o.Password == u.Password && u.Allowed(id)
+}
+
+// closeUsers 关闭满足条件的用户端会话或连接
+func (s *Server) closeUsers(match func(*userConn) bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for c, u := range s.users {
+		if match(u) {
+			s.logger.Warnf("user(%s id:%d) credentials revoked, close", u.name, u.id)
+			c.Close()
+		}
+	}
+}
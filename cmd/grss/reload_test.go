@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/howmp/reality"
+	"github.com/sirupsen/logrus"
+)
+
+func TestCredentialsValid(t *testing.T) {
+	alice := &reality.UserConfig{Name: "alice", Password: "secret", Clients: []int{1}}
+	open := &reality.ServerConfig{}
+	auth := &reality.ServerConfig{Users: []*reality.UserConfig{alice}}
+	cases := []struct {
+		old, config *reality.ServerConfig
+		name        string
+		id          byte
+		want        bool
+	}{
+		{open, open, "", 1, true},
+		{auth, open, "alice", 1, true},
+		{open, auth, "alice", 1, false},
+		{auth, auth, "alice", 1, true},
+		{auth, auth, "alice", 2, false},
+		{auth, &reality.ServerConfig{Users: []*reality.UserConfig{{Name: "alice", Password: "changed", Clients: []int{1}}}}, "alice", 1, false},
+		{auth, &reality.ServerConfig{Users: []*reality.UserConfig{{Name: "bob", Password: "secret", Clients: []int{1}}}}, "alice", 1, false},
+	}
+	for i, c := range cases {
+		if got := credentialsValid(c.old, c.config, c.name, c.id); got != c.want {
+			t.Fatalf("case %d: got %v, want %v", i, got, c.want)
+		}
+	}
+}
+
+// addTestUser 模拟已认证的用户端连接，返回用户端侧
+func addTestUser(s *Server, name string, id byte) net.Conn {
+	serverConn, userConn := net.Pipe()
+	s.addUser(serverConn, name, id)
+	return userConn
+}
+
+func isClosed(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	return true
+}
+
+func TestReload(t *testing.T) {
+	s := newTestServer(t)
+	s.config = &reality.ServerConfig{
+		ServerAddr: "127.0.0.1:443",
+		Users: []*reality.UserConfig{
+			{Name: "alice", Password: "secret", Clients: []int{1}},
+			{Name: "bob", Password: "secret", Clients: []int{1, 2}},
+		},
+	}
+	alice := addTestUser(s, "alice", 1)
+	bob1 := addTestUser(s, "bob", 1)
+	bob2 := addTestUser(s, "bob", 2)
+
+	s.Reload(&reality.ServerConfig{
+		ServerAddr:    "127.0.0.1:8443",
+		SessionPolicy: reality.SessionPolicyReplace,
+		Users: []*reality.UserConfig{
+			{Name: "alice", Password: "secret", Clients: []int{1}, DailyQuota: 1024},
+			{Name: "bob", Password: "secret", Clients: []int{1}},
+		},
+	})
+	if isClosed(alice) || isClosed(bob1) {
+		t.Fatal("valid users should be kept")
+	}
+	if !isClosed(bob2) {
+		t.Fatal("revoked user should be closed")
+	}
+	config := s.currentConfig()
+	if config.ServerAddr != "127.0.0.1:443" {
+		t.Fatalf("server_addr should need restart, got %s", config.ServerAddr)
+	}
+	if config.User("alice").DailyQuota != 1024 {
+		t.Fatal("quota not reloaded")
+	}
+	if policy, _ := s.sm.sessionPolicy(); policy != reality.SessionPolicyReplace {
+		t.Fatalf("session policy %s", policy)
+	}
+
+	// 密钥变化后关闭所有会话
+	client := dialSession(t, s.sm, 1)
+	s.Reload(&reality.ServerConfig{PrivateKeyECDH: "changed"})
+	waitClosed(t, client)
+	if !isClosed(alice) {
+		t.Fatal("user should be closed after keys changed")
+	}
+}
+
+// TestReloadPushPolicy SIGHUP重新读取配置文件后向在线客户端下发变化的策略
+func TestReloadPushPolicy(t *testing.T) {
+	config, err := reality.NewServerConfig("example.com:443", "127.0.0.1:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeTestConfig(t, path, config)
+	sv := &serv{ConfigPath: path}
+	s := newTestServer(t)
+	if s.config, err = loadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	session := dialSession(t, s.sm, 1)
+
+	config.ClientPolicies = map[byte]*reality.ClientPolicy{1: {Rules: []string{"deny 10.0.0.0/8"}}}
+	writeTestConfig(t, path, config)
+	if err := sv.reload(s, logrus.New()); err != nil {
+		t.Fatal(err)
+	}
+	if p := receivePolicy(t, session, ""); len(p.Rules) != 1 {
+		t.Fatalf("policy %+v", p)
+	}
+	if session.IsClosed() {
+		t.Fatal("session should be kept")
+	}
+
+	// 配置无效时保持原配置
+	os.WriteFile(path, []byte("{"), 0o600)
+	if err := sv.reload(s, logrus.New()); err == nil {
+		t.Fatal("invalid config reloaded")
+	}
+	if p := s.sm.clientPolicy(1); p == nil || len(p.Rules) != 1 {
+		t.Fatalf("policy %+v", p)
+	}
+}
+
+func writeTestConfig(t *testing.T, path string, config *reality.ServerConfig) {
+	t.Helper()
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,175 +1,729 @@
-package main
-
-import (
-	"fmt"
-	"io"
-	"net"
-	"sync"
-
-	"github.com/hashicorp/yamux"
-	"github.com/howmp/reality"
-	"github.com/howmp/reality/cmd"
-	"github.com/sirupsen/logrus"
-)
-
-type serv struct {
-	ConfigPath string `short:"o" default:"config.json" description:"server config path"`
-}
-
-func (s *serv) Execute(args []string) error {
-	config, err := loadConfig(s.ConfigPath)
-	if err != nil {
-		return err
-	}
-	server := NewServer(config)
-	server.Serve()
-	return nil
-}
-
-type sessionManager struct {
-	logger       logrus.FieldLogger
-	sessions     [128]*yamux.Session
-	sessionsLock [128]sync.Mutex
-}
-
-func (s *sessionManager) createSession(conn net.Conn, id byte) {
-	if s.isSessionOpen(id) {
-		s.logger.Errorf("client(id:%d) session already open, close %s", id, conn.RemoteAddr())
-		conn.Close()
-		return
-	}
-	s.sessionsLock[id].Lock()
-	defer s.sessionsLock[id].Unlock()
-	session, err := yamux.Server(conn, nil)
-	if err != nil {
-		s.logger.Error(err)
-		conn.Close()
-	}
-	go s.checkSession(id, session)
-	s.sessions[id] = session
-	s.logger.Infof("client(id:%d) session opened %s", id, conn.RemoteAddr())
-}
-
-func (s *sessionManager) isSessionOpen(id byte) bool {
-	s.sessionsLock[id].Lock()
-	defer s.sessionsLock[id].Unlock()
-	session := s.sessions[id]
-	if session != nil {
-		return !session.IsClosed()
-	}
-	return false
-}
-
-func (s *sessionManager) openClientSessionStream(id byte) (*yamux.Stream, error) {
-	s.sessionsLock[id].Lock()
-	defer s.sessionsLock[id].Unlock()
-	session := s.sessions[id]
-	if session != nil {
-		stream, err := session.OpenStream()
-		if err != nil {
-			session.Close()
-			s.sessions[id] = nil
-			return nil, err
-		}
-		return stream, nil
-	}
-	return nil, fmt.Errorf("client(id:%d) session not open", id)
-}
-
-func (s *sessionManager) checkSession(id byte, session *yamux.Session) {
-	<-session.CloseChan()
-	s.logger.Infof("client session closed %s", session.RemoteAddr())
-	s.sessionsLock[id].Lock()
-	defer s.sessionsLock[id].Unlock()
-	if s.sessions[id] == session {
-		s.sessions[id] = nil
-	}
-}
-
-// Server 反向socks5代理服务端
-type Server struct {
-	config *reality.ServerConfig
-	logger logrus.FieldLogger
-	sm     *sessionManager
-}
-
-func NewServer(config *reality.ServerConfig) *Server {
-	logger := reality.GetLogger(config.Debug)
-	return &Server{
-		config: config,
-		logger: logger,
-		sm: &sessionManager{
-			logger: logger,
-		},
-	}
-}
-
-// Serve 监听端口,同时接收Reality客户端和用户连接
-func (s *Server) Serve() {
-	_, port, err := net.SplitHostPort(s.config.ServerAddr)
-	if err != nil {
-		s.logger.Fatalf("split ServerAddr %s : %v", s.config.ServerAddr, err)
-	}
-	bindAddr := fmt.Sprintf(":%s", port)
-	l, err := reality.Listen(bindAddr, s.config)
-	if err != nil {
-		s.logger.Fatalf("reality listen: %v", err)
-	}
-	s.logger.Infof("reality listen %s", bindAddr)
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			s.logger.Errorf("reality accept: %v", err)
-			continue
-		}
-
-		if o, ok := conn.(reality.OverlayData); ok {
-			isGRSC, id := cmd.ParseShortID(o.OverlayData())
-			if isGRSC {
-				s.logger.Infof("accept client(id:%d) %s", id, conn.RemoteAddr())
-
-				go s.sm.createSession(conn, id)
-				continue
-			} else {
-				s.logger.Infof("accept user(id:%d) %s", id, conn.RemoteAddr())
-				go s.handleUser(conn, id)
-				continue
-			}
-		}
-		s.logger.Warnf("accept %s, but no overlay data", conn.RemoteAddr())
-		conn.Close()
-	}
-}
-
-func (s *Server) handleUser(conn net.Conn, id byte) {
-	defer conn.Close()
-
-	session, err := yamux.Client(conn, nil)
-	if err != nil {
-		s.logger.Errorf("user(id:%d) yamux: %v", id, err)
-		return
-	}
-	defer session.Close()
-	for {
-		stream, err := session.Accept()
-		if err != nil {
-			s.logger.Errorf("user(id:%d) session accept: %v", id, err)
-			return
-		}
-		s.logger.Infof("user(id:%d) stream accept %s", id, stream.RemoteAddr())
-		go s.handleUserStream(stream, id)
-
-	}
-}
-func (s *Server) handleUserStream(stream net.Conn, id byte) {
-	defer stream.Close()
-	conn, err := s.sm.openClientSessionStream(id)
-	if err != nil {
-		s.logger.Errorf("open client(id:%d) session stream: %v", id, err)
-		return
-	}
-	defer conn.Close()
-	go io.Copy(conn, stream)
-	io.Copy(stream, conn)
-
-}
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/howmp/reality"
+	"github.com/howmp/reality/cmd"
+	"github.com/sirupsen/logrus"
+)
+
+type serv struct {
+	ConfigPath   string         `short:"o" default:"config.json" description:"server config path"`
+	DrainTimeout time.Duration  `long:"drain-timeout" default:"30s" description:"max time to wait for streams to finish on SIGTERM/SIGINT"`
+	Log          cmd.LogOptions `group:"Log Options"`
+}
+
+func (s *serv) Execute(args []string) error {
+	config, err := loadConfig(s.ConfigPath)
+	if err != nil {
+		return err
+	}
+	logger, closer, err := s.Log.NewLogger(config.Debug)
+	if err != nil {
+		return err
+	}
+	if closer != nil {
+		defer closer.Close()
+	}
+	config.Logger = logger
+	config.UnsafeLogKeys = config.UnsafeLogKeys || s.Log.UnsafeKeys
+	server, err := NewServer(config)
+	if err != nil {
+		return err
+	}
+	go s.reloadOnSignal(server, logger)
+	served := make(chan error, 1)
+	go func() { served <- server.Serve() }()
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(c)
+	select {
+	case err := <-served:
+		// 监听失败时也保存流量统计
+		ctx, cancel := context.WithTimeout(context.Background(), s.DrainTimeout)
+		defer cancel()
+		return errors.Join(err, server.Shutdown(ctx))
+	case sig := <-c:
+		logger.Infof("received %s, draining streams for up to %s, send again to close now", sig, s.DrainTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), s.DrainTimeout)
+		defer cancel()
+		go func() {
+			select {
+			case <-c:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		err := errors.Join(server.Shutdown(ctx), <-served)
+		if err == nil {
+			logger.Infof("server closed")
+		}
+		return err
+	}
+}
+
+// reloadOnSignal 收到SIGHUP时重新加载配置，未指定--log-level时按新配置的debug调整日志级别
+func (s *serv) reloadOnSignal(server *Server, logger *logrus.Logger) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		if err := s.reload(server, logger); err != nil {
+			server.logger.Errorf("reload config: %v", err)
+			continue
+		}
+		server.logger.Infof("config reloaded")
+	}
+}
+
+// reload 重新读取配置文件并替换服务端配置
+func (s *serv) reload(server *Server, logger *logrus.Logger) error {
+	config, err := loadConfig(s.ConfigPath)
+	if err != nil {
+		return err
+	}
+	if level, err := s.Log.ParseLevel(config.Debug); err == nil {
+		logger.SetLevel(level)
+	}
+	config.UnsafeLogKeys = config.UnsafeLogKeys || s.Log.UnsafeKeys
+	config.Logger = logger
+	server.Reload(config)
+	return nil
+}
+
+type sessionManager struct {
+	logger       logrus.FieldLogger
+	policy       string // 重新加载时替换，通过sessionPolicy读取
+	strategy     string
+	policyLock   sync.RWMutex
+	mux          *reality.MuxConfig
+	limits       *rateLimits
+	audit        *auditor
+	sessions     [128][]cmd.Mux
+	sessionsLock [128]sync.Mutex
+	next         [128]int
+	streams      int64 // 正在转发的流，关闭服务端时等待其结束
+
+	// none模式下按会话ID查找会话，用于加入客户端后续建立的连接
+	connMuxes     map[cmd.SessionID]*connMuxEntry
+	connMuxesLock sync.Mutex
+
+	clientPolicies     map[byte]*reality.ClientPolicy
+	clientPoliciesLock sync.RWMutex
+}
+
+type connMuxEntry struct {
+	id  byte
+	mux *cmd.ConnMux
+}
+
+// acceptClient 按多路复用模式处理客户端连接
+func (s *sessionManager) acceptClient(conn net.Conn, id byte) {
+	if s.mux.Multiplexed() {
+		s.createSession(conn, id)
+		return
+	}
+	s.acceptConn(conn, id)
+}
+
+// createSession 在连接上建立yamux会话并加入会话表
+func (s *sessionManager) createSession(conn net.Conn, id byte) {
+	session, err := cmd.NewMuxSession(conn, s.mux, false)
+	if err != nil {
+		s.logger.Error(err)
+		conn.Close()
+		return
+	}
+	s.addSession(id, session)
+}
+
+// acceptConn none模式下读取握手，主连接创建会话，其他连接加入同一会话ID的会话
+func (s *sessionManager) acceptConn(conn net.Conn, id byte) {
+	conn.SetReadDeadline(time.Now().Add(authTimeout))
+	kind, sid, err := cmd.ReadHello(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		s.logger.Errorf("client(id:%d) %s read hello: %v", id, conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	s.connMuxesLock.Lock()
+	if s.connMuxes == nil {
+		s.connMuxes = make(map[cmd.SessionID]*connMuxEntry)
+	}
+	entry := s.connMuxes[sid]
+	if kind == cmd.HelloSession && entry == nil {
+		entry = &connMuxEntry{id: id, mux: cmd.NewConnMux(conn, s.mux)}
+		s.connMuxes[sid] = entry
+		s.connMuxesLock.Unlock()
+		go func() {
+			<-entry.mux.CloseChan()
+			s.connMuxesLock.Lock()
+			delete(s.connMuxes, sid)
+			s.connMuxesLock.Unlock()
+		}()
+		s.addSession(id, entry.mux)
+		return
+	}
+	s.connMuxesLock.Unlock()
+	if entry == nil || entry.id != id || kind == cmd.HelloSession {
+		s.logger.Warnf("client(id:%d) %s unknown session", id, conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	if err := entry.mux.AddConn(kind, conn); err != nil {
+		s.logger.Warnf("client(id:%d) %s add conn: %v", id, conn.RemoteAddr(), err)
+		conn.Close()
+	}
+}
+
+// addSession 根据重复会话策略，将新会话加入会话表，检查和替换在同一把锁内完成
+func (s *sessionManager) addSession(id byte, session cmd.Mux) {
+	s.sessionsLock[id].Lock()
+	defer s.sessionsLock[id].Unlock()
+	opened := s.openSessions(id)
+	policy, _ := s.sessionPolicy()
+	if len(opened) > 0 {
+		switch policy {
+		case reality.SessionPolicyReplace:
+			for _, old := range opened {
+				s.logger.Warnf("client(id:%d) session replaced, close %s", id, old.RemoteAddr())
+				old.Close()
+			}
+			opened = nil
+		case reality.SessionPolicyGroup:
+			s.logger.Infof("client(id:%d) session group size %d", id, len(opened)+1)
+		default:
+			s.logger.Errorf("client(id:%d) session already open, close %s", id, session.RemoteAddr())
+			session.Close()
+			return
+		}
+	}
+	s.sessions[id] = append(opened, session)
+	go s.checkSession(id, session)
+	go s.acceptStreams(id, session)
+	if p := s.clientPolicy(id); p != nil {
+		go s.pushPolicy(id, session, p)
+	}
+	s.logger.Infof("client(id:%d) session opened %s", id, session.RemoteAddr())
+}
+
+// sessionPolicy 返回重复会话策略和组内选择会话的策略
+func (s *sessionManager) sessionPolicy() (string, string) {
+	s.policyLock.RLock()
+	defer s.policyLock.RUnlock()
+	return s.policy, s.strategy
+}
+
+// setSessionPolicy 只影响之后建立的会话和打开的流，已有的会话不受影响
+func (s *sessionManager) setSessionPolicy(policy, strategy string) {
+	s.policyLock.Lock()
+	defer s.policyLock.Unlock()
+	s.policy, s.strategy = policy, strategy
+}
+
+// openSessions 返回未关闭的会话，需持有sessionsLock[id]
+func (s *sessionManager) openSessions(id byte) []cmd.Mux {
+	opened := s.sessions[id][:0]
+	for _, session := range s.sessions[id] {
+		if !session.IsClosed() {
+			opened = append(opened, session)
+		}
+	}
+	s.sessions[id] = opened
+	return opened
+}
+
+func (s *sessionManager) isSessionOpen(id byte) bool {
+	s.sessionsLock[id].Lock()
+	defer s.sessionsLock[id].Unlock()
+	return len(s.openSessions(id)) > 0
+}
+
+// openClientSessionStream 按组策略选择会话打开流，打开失败则关闭该会话并尝试组内其他会话
+func (s *sessionManager) openClientSessionStream(id byte) (net.Conn, error) {
+	s.sessionsLock[id].Lock()
+	defer s.sessionsLock[id].Unlock()
+	var errs []error
+	for {
+		opened := s.openSessions(id)
+		if len(opened) == 0 {
+			errs = append(errs, fmt.Errorf("client(id:%d) session not open", id))
+			return nil, errors.Join(errs...)
+		}
+		session := s.pickSession(id, opened)
+		stream, err := session.Open()
+		if err == nil {
+			return stream, nil
+		}
+		s.logger.Warnf("client(id:%d) open stream %s: %v, failover", id, session.RemoteAddr(), err)
+		errs = append(errs, err)
+		session.Close()
+		s.removeSession(id, session)
+	}
+}
+
+// pickSession 按组策略从opened中选择会话，需持有sessionsLock[id]
+func (s *sessionManager) pickSession(id byte, opened []cmd.Mux) cmd.Mux {
+	if _, strategy := s.sessionPolicy(); strategy == reality.GroupStrategyLeastStreams {
+		session := opened[0]
+		for _, v := range opened[1:] {
+			if v.NumStreams() < session.NumStreams() {
+				session = v
+			}
+		}
+		return session
+	}
+	s.next[id] = (s.next[id] + 1) % len(opened)
+	return opened[s.next[id]]
+}
+
+// removeSession 从会话表中移除指定会话，需持有sessionsLock[id]
+func (s *sessionManager) removeSession(id byte, session cmd.Mux) {
+	sessions := s.sessions[id]
+	for i, v := range sessions {
+		if v == session {
+			s.sessions[id] = append(sessions[:i:i], sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *sessionManager) checkSession(id byte, session cmd.Mux) {
+	<-session.CloseChan()
+	s.logger.Infof("client(id:%d) session closed %s", id, session.RemoteAddr())
+	s.sessionsLock[id].Lock()
+	defer s.sessionsLock[id].Unlock()
+	s.removeSession(id, session)
+}
+
+const (
+	authTimeout    = 10 * time.Second // 用户端发送认证信息的超时时间
+	controlTimeout = 10 * time.Second // 客户端确认控制消息的超时时间
+)
+
+func (s *sessionManager) clientPolicy(id byte) *reality.ClientPolicy {
+	s.clientPoliciesLock.RLock()
+	p := s.clientPolicies[id]
+	s.clientPoliciesLock.RUnlock()
+	return s.withAudit(p)
+}
+
+// withAudit 开启审计时返回设置了Audit的策略副本，未开启审计时原样返回
+func (s *sessionManager) withAudit(p *reality.ClientPolicy) *reality.ClientPolicy {
+	if !s.audit.enabled() {
+		return p
+	}
+	c := reality.ClientPolicy{}
+	if p != nil {
+		c = *p
+	}
+	c.Audit = true
+	return &c
+}
+
+// setClientPolicies 替换运行时策略，并下发给策略有变化的在线客户端，被移除策略的客户端恢复默认值
+func (s *sessionManager) setClientPolicies(policies map[byte]*reality.ClientPolicy) {
+	s.clientPoliciesLock.Lock()
+	old := s.clientPolicies
+	s.clientPolicies = policies
+	s.clientPoliciesLock.Unlock()
+	for id := 0; id < len(s.sessions); id++ {
+		p, ok := policies[byte(id)]
+		if !ok {
+			if _, ok := old[byte(id)]; !ok {
+				continue
+			}
+			p = &reality.ClientPolicy{}
+		} else if reflect.DeepEqual(p, old[byte(id)]) {
+			continue
+		}
+		p = s.withAudit(p)
+		s.sessionsLock[id].Lock()
+		opened := append([]cmd.Mux(nil), s.openSessions(byte(id))...)
+		s.sessionsLock[id].Unlock()
+		for _, session := range opened {
+			go s.pushPolicy(byte(id), session, p)
+		}
+	}
+}
+
+// pushPolicy 打开控制流下发运行时策略，并等待客户端确认
+func (s *sessionManager) pushPolicy(id byte, session cmd.Mux, policy *reality.ClientPolicy) {
+	if err := s.sendControl(session, cmd.MessagePolicy, policy); err != nil {
+		s.logger.Errorf("client(id:%d) %s push policy: %v", id, session.RemoteAddr(), err)
+		return
+	}
+	s.logger.Infof("client(id:%d) %s policy applied", id, session.RemoteAddr())
+}
+
+// sendControl 打开控制流发送控制消息，并等待客户端确认
+func (s *sessionManager) sendControl(session cmd.Mux, messageType byte, v interface{}) error {
+	stream, err := session.Open()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(controlTimeout))
+	if err := cmd.WriteStreamType(stream, cmd.StreamControl); err != nil {
+		return err
+	}
+	if err := cmd.WriteMessage(stream, messageType, v); err != nil {
+		return err
+	}
+	ackType, data, err := cmd.ReadMessage(stream)
+	if err != nil {
+		return err
+	}
+	if ackType != cmd.MessageAck {
+		return fmt.Errorf("unexpected message type %d", ackType)
+	}
+	var ack cmd.AckMessage
+	if err := json.Unmarshal(data, &ack); err != nil {
+		return err
+	}
+	if ack.Error != "" {
+		return errors.New(ack.Error)
+	}
+	return nil
+}
+
+// acceptStreams 接收客户端主动打开的流
+func (s *sessionManager) acceptStreams(id byte, session cmd.Mux) {
+	limiter := cmd.NewStreamLimiter(s.mux)
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return
+		}
+		if !limiter.Acquire() {
+			s.logger.Warnf("client(id:%d) too many streams, close %s", id, stream.RemoteAddr())
+			stream.Close()
+			continue
+		}
+		go func() {
+			defer limiter.Release()
+			s.handleClientStream(id, stream)
+		}()
+	}
+}
+
+func (s *sessionManager) handleClientStream(id byte, stream net.Conn) {
+	defer stream.Close()
+	streamType, err := cmd.ReadStreamType(stream)
+	if err != nil {
+		s.logger.Errorf("client(id:%d) read stream type: %v", id, err)
+		return
+	}
+	switch streamType {
+	case cmd.StreamReport:
+	case cmd.StreamForward:
+		s.handleClientForward(id, stream)
+		return
+	default:
+		s.logger.Errorf("client(id:%d) unknown stream type %d", id, streamType)
+		return
+	}
+	// 上报流上依次发送多条消息，直到客户端关闭
+	for {
+		messageType, data, err := cmd.ReadMessage(stream)
+		if err != nil {
+			if err != io.EOF {
+				s.logger.Errorf("client(id:%d) read message: %v", id, err)
+			}
+			return
+		}
+		if err := s.handleMessage(id, messageType, data); err != nil {
+			s.logger.Errorf("client(id:%d) message: %v", id, err)
+			return
+		}
+	}
+}
+
+func (s *sessionManager) handleMessage(id byte, messageType byte, data []byte) error {
+	switch messageType {
+	case cmd.MessageDeny:
+		var m cmd.DenyMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		s.logger.Warnf("client(id:%d) deny %s by rule %q", id, m.Dest, m.Rule)
+	case cmd.MessageAudit:
+		var m cmd.AuditMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		s.audit.report(id, &m)
+	default:
+		return fmt.Errorf("unknown message type %d", messageType)
+	}
+	return nil
+}
+
+// Server 反向socks5代理服务端
+type Server struct {
+	config     *reality.ServerConfig // 重新加载时替换，通过currentConfig读取
+	configLock sync.RWMutex
+	logger     logrus.FieldLogger
+	sm         *sessionManager
+	traffic    *traffic
+
+	// 以下用于关闭服务端和重新加载配置
+	lock      sync.Mutex
+	closing   bool
+	listeners []net.Listener
+	users     map[io.Closer]*userConn // 用户端的yamux会话，none模式下为每个连接
+}
+
+// userConn 已认证的用户端，重新加载配置后凭据失效时关闭
+type userConn struct {
+	name string
+	id   byte
+}
+
+func (s *Server) currentConfig() *reality.ServerConfig {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return s.config
+}
+
+// NewServer 未注入Logger时创建一个，并写回config，与reality.Listen共用
+func NewServer(config *reality.ServerConfig) (*Server, error) {
+	if config.Logger == nil {
+		config.Logger = reality.GetLogger(config.Debug)
+	}
+	logger := config.Logger
+	file := ""
+	if config.Traffic != nil {
+		file = config.Traffic.File
+	}
+	t, err := newTraffic(file)
+	if err != nil {
+		return nil, err
+	}
+	audit, err := newAuditor(config.Audit, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		config:  config,
+		logger:  logger,
+		traffic: t,
+		sm: &sessionManager{
+			logger:         logger,
+			policy:         config.SessionPolicy,
+			strategy:       config.GroupStrategy,
+			mux:            config.Mux,
+			limits:         newRateLimits(config.RateLimits),
+			audit:          audit,
+			clientPolicies: config.ClientPolicies,
+		},
+	}, nil
+}
+
+// Serve 监听端口,同时接收Reality客户端和用户连接，调用Shutdown后返回nil
+func (s *Server) Serve() error {
+	config := s.currentConfig()
+	var listeners []net.Listener
+	for _, lc := range config.AllListeners() {
+		l, err := reality.Listen(lc.Listen, config.ForListener(lc))
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("reality listen %s: %w", lc.Listen, err)
+		}
+		listeners = append(listeners, l)
+	}
+	if !s.addListeners(listeners...) {
+		return nil
+	}
+	for i, lc := range config.AllListeners() {
+		s.logger.Infof("reality listen %s, sni %s", listeners[i].Addr(), lc.SNIAddr)
+	}
+	if len(config.Users) == 0 {
+		s.logger.Warnln("no users configured, user auth disabled")
+	}
+	for _, f := range config.Forwards {
+		go s.serveForward(f)
+	}
+	go s.sm.limits.logStats(s.logger)
+	go logTargetStats(listeners, s.logger)
+	go s.traffic.saveLoop(s.trafficSaveInterval(), s.logger)
+	// 所有监听共用会话，任一监听出错时返回
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) { errs <- s.accept(l) }(l)
+	}
+	for range listeners {
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// accept 接收一个监听上的客户端和用户端连接，关闭服务端后返回nil
+func (s *Server) accept(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosing() {
+				return nil
+			}
+			return fmt.Errorf("reality accept %s: %w", l.Addr(), err)
+		}
+
+		if o, ok := conn.(reality.OverlayData); ok {
+			isGRSC, id := cmd.ParseShortID(o.OverlayData())
+			if isGRSC {
+				s.logger.Infof("accept client(id:%d) %s", id, conn.RemoteAddr())
+
+				go s.sm.acceptClient(conn, id)
+				continue
+			} else {
+				s.logger.Infof("accept user(id:%d) %s", id, conn.RemoteAddr())
+				go s.handleUser(conn, id)
+				continue
+			}
+		}
+		s.logger.Warnf("accept %s, but no overlay data", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+func (s *Server) trafficSaveInterval() time.Duration {
+	config := s.currentConfig()
+	if config.Traffic == nil || config.Traffic.SaveSecond == 0 {
+		return defaultTrafficSave
+	}
+	return time.Duration(config.Traffic.SaveSecond) * time.Second
+}
+
+// authUser 读取并校验用户端认证信息，未配置用户时不校验
+func (s *Server) authUser(conn net.Conn, id byte) (string, error) {
+	conn.SetDeadline(time.Now().Add(authTimeout))
+	defer conn.SetDeadline(time.Time{})
+	name, password, err := cmd.ReadAuth(conn)
+	if err != nil {
+		return "", err
+	}
+	config := s.currentConfig()
+	if len(config.Users) == 0 {
+		return name, cmd.WriteAuthResult(conn, cmd.AuthOK)
+	}
+	u := config.User(name)
+	if u == nil || subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) != 1 {
+		cmd.WriteAuthResult(conn, cmd.AuthFailed)
+		return name, cmd.ErrAuthFailed
+	}
+	if !u.Allowed(id) {
+		cmd.WriteAuthResult(conn, cmd.AuthDenied)
+		return name, cmd.ErrAuthDenied
+	}
+	return name, cmd.WriteAuthResult(conn, cmd.AuthOK)
+}
+
+func (s *Server) handleUser(conn net.Conn, id byte) {
+	defer conn.Close()
+	name, err := s.authUser(conn, id)
+	if err != nil {
+		s.logger.Warnf("user(%s id:%d) %s auth: %v", name, id, conn.RemoteAddr(), err)
+		return
+	}
+	s.logger.Infof("user(%s id:%d) auth ok", name, id)
+	config := s.currentConfig()
+	user := name
+	if len(config.Users) == 0 {
+		// 未启用认证时用户名不可信，不按用户限速和统计
+		user = ""
+	}
+	if !config.Mux.Multiplexed() {
+		// none模式下每个连接就是一个流
+		s.addUser(conn, name, id)
+		defer s.removeUser(conn)
+		s.handleUserStream(conn, id, user)
+		return
+	}
+
+	session, err := cmd.NewMuxSession(conn, config.Mux, true)
+	if err != nil {
+		s.logger.Errorf("user(%s id:%d) yamux: %v", name, id, err)
+		return
+	}
+	defer session.Close()
+	s.addUser(session, name, id)
+	defer s.removeUser(session)
+	limiter := cmd.NewStreamLimiter(config.Mux)
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			s.logger.Errorf("user(%s id:%d) session accept: %v", name, id, err)
+			return
+		}
+		if !limiter.Acquire() {
+			s.logger.Warnf("user(%s id:%d) too many streams, close %s", name, id, stream.RemoteAddr())
+			stream.Close()
+			continue
+		}
+		s.logger.Infof("user(%s id:%d) stream accept %s", name, id, stream.RemoteAddr())
+		go func() {
+			defer limiter.Release()
+			s.handleUserStream(stream, id, user)
+		}()
+	}
+}
+
+// handleUserStream 将用户端的流转发到客户端，user为按用户限速和统计流量使用的用户名
+func (s *Server) handleUserStream(stream net.Conn, id byte, user string) {
+	defer s.sm.trackStream()()
+	defer stream.Close()
+	streamType, err := cmd.ReadStreamType(stream)
+	if err != nil {
+		s.logger.Errorf("user(id:%d) read stream type: %v", id, err)
+		return
+	}
+	switch streamType {
+	case cmd.StreamSocks, cmd.StreamUDP, cmd.StreamForward, cmd.StreamDNS:
+	default:
+		s.logger.Errorf("user(id:%d) unknown stream type %d", id, streamType)
+		return
+	}
+	if err := s.traffic.quotaExceeded(s.currentConfig().User(user)); err != nil {
+		s.logger.Warnf("user(%s id:%d) %v, refuse stream", user, id, err)
+		return
+	}
+	conn, err := s.sm.openClientSessionStream(id)
+	if err != nil {
+		s.logger.Errorf("open client(id:%d) session stream: %v", id, err)
+		return
+	}
+	defer conn.Close()
+	if err := cmd.WriteStreamType(conn, streamType); err != nil {
+		s.logger.Errorf("client(id:%d) write stream type: %v", id, err)
+		return
+	}
+	counted := s.traffic.countUser(stream, user, id)
+	sid := s.sm.audit.begin(user, id, streamType)
+	defer func() { s.sm.audit.end(sid, counted.uploaded(), counted.downloaded()) }()
+	if err := cmd.WriteStreamID(conn, sid); err != nil {
+		s.logger.Errorf("client(id:%d) write stream id: %v", id, err)
+		return
+	}
+	limited := s.sm.limits.limitUser(counted, user, id)
+	go io.Copy(conn, limited)
+	io.Copy(limited, conn)
+
+}
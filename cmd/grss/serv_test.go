@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/howmp/reality"
+	"github.com/howmp/reality/cmd"
+)
+
+// dialSession 模拟grsc连接，返回客户端侧的yamux会话
+func dialSession(t *testing.T, sm *sessionManager, id byte) *yamux.Session {
+	t.Helper()
+	session, err := connectSession(sm, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { session.Close() })
+	return session
+}
+
+// connectSession 与dialSession相同，可在其他goroutine中调用，由调用者关闭会话
+func connectSession(sm *sessionManager, id byte) (*yamux.Session, error) {
+	serverConn, clientConn := net.Pipe()
+	session, err := yamux.Client(clientConn, nil)
+	if err != nil {
+		return nil, err
+	}
+	sm.createSession(serverConn, id)
+	return session, nil
+}
+
+func waitClosed(t *testing.T, session *yamux.Session) {
+	t.Helper()
+	select {
+	case <-session.CloseChan():
+	case <-time.After(time.Second):
+		t.Fatal("session should be closed")
+	}
+}
+
+func newTestSessionManager(policy string) *sessionManager {
+	return &sessionManager{logger: reality.GetLogger(false), policy: policy, limits: newRateLimits(nil)}
+}
+
+func TestSessionPolicyReject(t *testing.T) {
+	sm := newTestSessionManager(reality.SessionPolicyReject)
+	first := dialSession(t, sm, 1)
+	second := dialSession(t, sm, 1)
+	waitClosed(t, second)
+	if first.IsClosed() {
+		t.Fatal("first session should be kept")
+	}
+	if !sm.isSessionOpen(1) {
+		t.Fatal("session should be open")
+	}
+}
+
+func TestSessionPolicyReplace(t *testing.T) {
+	sm := newTestSessionManager(reality.SessionPolicyReplace)
+	first := dialSession(t, sm, 1)
+	second := dialSession(t, sm, 1)
+	waitClosed(t, first)
+	if second.IsClosed() {
+		t.Fatal("second session should be kept")
+	}
+	if len(sm.sessions[1]) != 1 {
+		t.Fatalf("want 1 session, got %d", len(sm.sessions[1]))
+	}
+}
+
+func TestSessionPolicyGroup(t *testing.T) {
+	sm := newTestSessionManager(reality.SessionPolicyGroup)
+	first := dialSession(t, sm, 1)
+	second := dialSession(t, sm, 1)
+	if first.IsClosed() || second.IsClosed() {
+		t.Fatal("both sessions should be kept")
+	}
+	if len(sm.sessions[1]) != 2 {
+		t.Fatalf("want 2 sessions, got %d", len(sm.sessions[1]))
+	}
+	first.Close()
+	time.Sleep(100 * time.Millisecond)
+	stream, err := sm.openClientSessionStream(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+}
+
+// TestSessionRapidReconnect 并发快速重连，每种策略下会话表都应保持一致
+func TestSessionRapidReconnect(t *testing.T) {
+	for _, policy := range []string{reality.SessionPolicyReject, reality.SessionPolicyReplace} {
+		sm := newTestSessionManager(policy)
+		var wg sync.WaitGroup
+		sessions := make(chan *yamux.Session, 32)
+		errs := make(chan error, 32)
+		for i := 0; i < 32; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				session, err := connectSession(sm, 2)
+				if err != nil {
+					errs <- err
+					return
+				}
+				sessions <- session
+			}()
+		}
+		wg.Wait()
+		close(sessions)
+		close(errs)
+		for session := range sessions {
+			session := session
+			t.Cleanup(func() { session.Close() })
+		}
+		for err := range errs {
+			t.Fatal(err)
+		}
+		sm.sessionsLock[2].Lock()
+		n := len(sm.openSessions(2))
+		sm.sessionsLock[2].Unlock()
+		if n != 1 {
+			t.Fatalf("policy %s: want 1 open session, got %d", policy, n)
+		}
+	}
+}
+
+func TestGroupLeastStreams(t *testing.T) {
+	sm := newTestSessionManager(reality.SessionPolicyGroup)
+	sm.strategy = reality.GroupStrategyLeastStreams
+	first := dialSession(t, sm, 3)
+	second := dialSession(t, sm, 3)
+	for i := 0; i < 4; i++ {
+		if _, err := sm.openClientSessionStream(3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, session := range sm.sessions[3] {
+		if n := session.NumStreams(); n != 2 {
+			t.Fatalf("want 2 streams per session, got %d", n)
+		}
+	}
+	first.Close()
+	second.Close()
+}
+
+// TestGroupFailover 组内会话失效后，打开流应自动切换到其他会话
+func TestGroupFailover(t *testing.T) {
+	sm := newTestSessionManager(reality.SessionPolicyGroup)
+	dead := dialSession(t, sm, 4)
+	dialSession(t, sm, 4)
+	// 会话未关闭但已无法打开流，模拟打开流时会话刚好失效
+	dead.GoAway()
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 4; i++ {
+		stream, err := sm.openClientSessionStream(4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.Close()
+	}
+	if len(sm.sessions[4]) != 1 {
+		t.Fatalf("want 1 session, got %d", len(sm.sessions[4]))
+	}
+}
+
+func TestAuthUser(t *testing.T) {
+	s := &Server{
+		config: &reality.ServerConfig{
+			Users: []*reality.UserConfig{{Name: "alice", Password: "secret", Clients: []int{1}}},
+		},
+		logger: reality.GetLogger(false),
+	}
+	cases := []struct {
+		user, password string
+		id             byte
+		want           error
+	}{
+		{"alice", "secret", 1, nil},
+		{"alice", "wrong", 1, cmd.ErrAuthFailed},
+		{"bob", "secret", 1, cmd.ErrAuthFailed},
+		{"alice", "secret", 2, cmd.ErrAuthDenied},
+	}
+	for _, c := range cases {
+		serverConn, clientConn := net.Pipe()
+		go func() {
+			cmd.WriteAuth(clientConn, c.user, c.password)
+		}()
+		errc := make(chan error, 1)
+		go func() { errc <- cmd.ReadAuthResult(clientConn) }()
+		if _, err := s.authUser(serverConn, c.id); err != c.want {
+			t.Fatalf("%s/%s id %d: server got %v, want %v", c.user, c.password, c.id, err, c.want)
+		}
+		if err := <-errc; err != c.want {
+			t.Fatalf("%s/%s id %d: user got %v, want %v", c.user, c.password, c.id, err, c.want)
+		}
+		serverConn.Close()
+		clientConn.Close()
+	}
+}
+
+// TestClientForward 客户端反向端口转发只能连接策略中配置的目标
+func TestClientForward(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	sm := newTestSessionManager(reality.SessionPolicyReject)
+	sm.clientPolicies = map[byte]*reality.ClientPolicy{
+		5: {Forwards: []*reality.ClientForward{{Listen: "127.0.0.1:0", Target: target.Addr().String()}}},
+	}
+	session := dialSession(t, sm, 5)
+	for _, c := range []struct {
+		target string
+		err    bool
+	}{
+		{target.Addr().String(), false},
+		{"127.0.0.1:1", true},
+	} {
+		stream, err := session.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, err := cmd.ParseAddr(c.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd.WriteStreamType(stream, cmd.StreamForward)
+		cmd.WriteForward(stream, addr)
+		err = cmd.ReadForwardReply(stream)
+		if (err != nil) != c.err {
+			t.Fatalf("forward %s: %v", c.target, err)
+		}
+		if err == nil {
+			stream.Write([]byte("hello"))
+			buf := make([]byte, 5)
+			if _, err := io.ReadFull(stream, buf); err != nil || string(buf) != "hello" {
+				t.Fatalf("forward %s: got %q, %v", c.target, buf, err)
+			}
+		}
+		stream.Close()
+	}
+}
+
+// dialConnSession 模拟none模式的grsc，返回客户端侧的会话
+func dialConnSession(t *testing.T, sm *sessionManager, id byte) *cmd.DialMux {
+	t.Helper()
+	sid, err := cmd.NewSessionID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := func(kind byte) (net.Conn, error) {
+		serverConn, clientConn := net.Pipe()
+		go sm.acceptConn(serverConn, id)
+		if err := cmd.WriteHello(clientConn, kind, sid); err != nil {
+			clientConn.Close()
+			return nil, err
+		}
+		return clientConn, nil
+	}
+	conn, err := dial(cmd.HelloSession)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := cmd.NewDialMux(conn, dial, 1, sm.mux)
+	t.Cleanup(func() { session.Close() })
+	return session
+}
+
+func TestSessionConnMode(t *testing.T) {
+	sm := newTestSessionManager(reality.SessionPolicyReject)
+	sm.mux = &reality.MuxConfig{Mode: reality.MuxModeNone}
+	session := dialConnSession(t, sm, 6)
+	deadline := time.Now().Add(time.Second)
+	for !sm.isSessionOpen(6) {
+		if time.Now().After(deadline) {
+			t.Fatal("session should be open")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stream, err := sm.openClientSessionStream(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	go cmd.WriteStreamType(stream, cmd.StreamSocks)
+	accepted, err := session.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	if streamType, err := cmd.ReadStreamType(accepted); err != nil || streamType != cmd.StreamSocks {
+		t.Fatalf("stream type %d: %v", streamType, err)
+	}
+
+	// 未知会话的连接应被关闭
+	serverConn, clientConn := net.Pipe()
+	go sm.acceptConn(serverConn, 7)
+	go cmd.WriteHello(clientConn, cmd.HelloIdle, cmd.SessionID{})
+	clientConn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := clientConn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("unknown session conn should be closed: %v", err)
+	}
+
+	session.Close()
+	deadline = time.Now().Add(time.Second)
+	for sm.isSessionOpen(6) {
+		if time.Now().After(deadline) {
+			t.Fatal("session should be closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// receivePolicy 模拟grsc接收下发的策略，ackErr不为空时在确认中回复错误
+func receivePolicy(t *testing.T, session *yamux.Session, ackErr string) *reality.ClientPolicy {
+	t.Helper()
+	received := make(chan *reality.ClientPolicy, 1)
+	go func() {
+		stream, err := session.Accept()
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+		if _, err := cmd.ReadStreamType(stream); err != nil {
+			return
+		}
+		messageType, data, err := cmd.ReadMessage(stream)
+		if err != nil || messageType != cmd.MessagePolicy {
+			return
+		}
+		var policy reality.ClientPolicy
+		if err := json.Unmarshal(data, &policy); err != nil {
+			return
+		}
+		cmd.WriteMessage(stream, cmd.MessageAck, &cmd.AckMessage{Error: ackErr})
+		received <- &policy
+	}()
+	select {
+	case policy := <-received:
+		return policy
+	case <-time.After(time.Second):
+		t.Fatal("policy not pushed")
+		return nil
+	}
+}
+
+// TestPushPolicy 客户端每次连接和策略变化时下发策略
+func TestPushPolicy(t *testing.T) {
+	sm := newTestSessionManager(reality.SessionPolicyReplace)
+	sm.clientPolicies = map[byte]*reality.ClientPolicy{1: {UploadLimit: 1024}}
+	session := dialSession(t, sm, 1)
+	if p := receivePolicy(t, session, ""); p.UploadLimit != 1024 {
+		t.Fatalf("policy %+v", p)
+	}
+
+	// 重连后重新下发
+	session.Close()
+	deadline := time.Now().Add(time.Second)
+	for sm.isSessionOpen(1) {
+		if time.Now().After(deadline) {
+			t.Fatal("session should be closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	session = dialSession(t, sm, 1)
+	if p := receivePolicy(t, session, ""); p.UploadLimit != 1024 {
+		t.Fatalf("policy %+v after reconnect", p)
+	}
+
+	// 策略不变时不下发，变化时下发，移除时下发空策略恢复默认值
+	sm.setClientPolicies(map[byte]*reality.ClientPolicy{1: {UploadLimit: 1024}, 2: {UploadLimit: 1}})
+	sm.setClientPolicies(map[byte]*reality.ClientPolicy{1: {UploadLimit: 2048}})
+	if p := receivePolicy(t, session, ""); p.UploadLimit != 2048 {
+		t.Fatalf("changed policy %+v", p)
+	}
+	sm.setClientPolicies(nil)
+	if p := receivePolicy(t, session, ""); p.UploadLimit != 0 {
+		t.Fatalf("removed policy %+v", p)
+	}
+
+	// 客户端应用失败时确认中带回错误
+	errs := make(chan error, 1)
+	go func() { errs <- sm.sendControl(sm.sessions[1][0], cmd.MessagePolicy, &reality.ClientPolicy{}) }()
+	receivePolicy(t, session, "bad policy")
+	if err := <-errs; err == nil || err.Error() != "bad policy" {
+		t.Fatalf("ack error %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/howmp/reality/cmd"
+)
+
+const drainCheckInterval = 100 * time.Millisecond
+
+// trackStream 记录正在转发的流，返回的函数在流结束时调用
+func (s *sessionManager) trackStream() func() {
+	atomic.AddInt64(&s.streams, 1)
+	return func() { atomic.AddInt64(&s.streams, -1) }
+}
+
+func (s *sessionManager) activeStreams() int64 {
+	return atomic.LoadInt64(&s.streams)
+}
+
+// goAwayClients 通知所有在线客户端连接其他服务端地址
+func (s *sessionManager) goAwayClients() {
+	for id := range s.sessions {
+		s.sessionsLock[id].Lock()
+		opened := append([]cmd.Mux(nil), s.openSessions(byte(id))...)
+		s.sessionsLock[id].Unlock()
+		for _, session := range opened {
+			go func(id byte, session cmd.Mux) {
+				if err := s.sendControl(session, cmd.MessageGoaway, struct{}{}); err != nil {
+					s.logger.Warnf("client(id:%d) %s goaway: %v", id, session.RemoteAddr(), err)
+				}
+			}(byte(id), session)
+		}
+	}
+}
+
+// closeSessions 关闭所有客户端会话
+func (s *sessionManager) closeSessions() {
+	for id := range s.sessions {
+		s.sessionsLock[id].Lock()
+		for _, session := range s.sessions[id] {
+			session.Close()
+		}
+		s.sessions[id] = nil
+		s.sessionsLock[id].Unlock()
+	}
+}
+
+// addListeners 关闭服务端时一并关闭，已在关闭时关闭listeners并返回false
+func (s *Server) addListeners(listeners ...net.Listener) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closing {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return false
+	}
+	s.listeners = append(s.listeners, listeners...)
+	return true
+}
+
+func (s *Server) isClosing() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closing
+}
+
+// addUser 记录已认证的用户端会话或连接，关闭服务端时通知用户端不再打开新流
+func (s *Server) addUser(c io.Closer, name string, id byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closing {
+		goAwayUser(c)
+	}
+	if s.users == nil {
+		s.users = make(map[io.Closer]*userConn)
+	}
+	s.users[c] = &userConn{name: name, id: id}
+}
+
+func (s *Server) removeUser(c io.Closer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.users, c)
+}
+
+// goAwayUser none模式下的连接只有一个流，等待其结束
+func goAwayUser(c io.Closer) {
+	if session, ok := c.(cmd.Mux); ok {
+		cmd.GoAway(session)
+	}
+}
+
+// Shutdown 停止接收新连接，通知客户端和用户端连接其他服务端，
+// 等待正在转发的流结束和客户端上报审计结果，ctx结束时强制关闭，最后保存流量统计并关闭审计日志
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lock.Lock()
+	if s.closing {
+		s.lock.Unlock()
+		return errors.New("server already shutting down")
+	}
+	s.closing = true
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.users {
+		goAwayUser(c)
+	}
+	s.lock.Unlock()
+	s.sm.goAwayClients()
+
+	if err := s.drain(ctx); err != nil {
+		s.logger.Warnf("drain: %v, close %d streams", err, s.sm.activeStreams())
+	} else {
+		s.logger.Infof("drain finished")
+	}
+	s.lock.Lock()
+	for c := range s.users {
+		c.Close()
+	}
+	s.lock.Unlock()
+	s.sm.closeSessions()
+	return errors.Join(s.traffic.save(), s.sm.audit.close())
+}
+
+// drain 等待正在转发的流结束和客户端上报审计结果
+func (s *Server) drain(ctx context.Context) error {
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	for s.sm.activeStreams() > 0 || s.sm.audit.pendingCount() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
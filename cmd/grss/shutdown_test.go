@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/howmp/reality"
+	"github.com/howmp/reality/cmd"
+)
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	sm := newTestSessionManager(reality.SessionPolicyGroup)
+	audit, err := newAuditor(nil, sm.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.audit = audit
+	return &Server{config: &reality.ServerConfig{}, logger: sm.logger, sm: sm, traffic: trafficFrom("", nil)}
+}
+
+// ackGoaway 模拟grsc确认关闭通知
+func ackGoaway(session *yamux.Session) <-chan byte {
+	received := make(chan byte, 1)
+	go func() {
+		stream, err := session.Accept()
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+		if _, err := cmd.ReadStreamType(stream); err != nil {
+			return
+		}
+		messageType, _, err := cmd.ReadMessage(stream)
+		if err != nil {
+			return
+		}
+		cmd.WriteMessage(stream, cmd.MessageAck, &cmd.AckMessage{})
+		received <- messageType
+	}()
+	return received
+}
+
+func TestShutdownDrain(t *testing.T) {
+	s := newTestServer(t)
+	client := dialSession(t, s.sm, 1)
+	received := ackGoaway(client)
+	done := s.sm.trackStream()
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	select {
+	case messageType := <-received:
+		if messageType != cmd.MessageGoaway {
+			t.Fatalf("message type %d", messageType)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("client not notified")
+	}
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown should wait for active streams")
+	case <-time.After(200 * time.Millisecond):
+	}
+	if client.IsClosed() {
+		t.Fatal("session should be kept while draining")
+	}
+	done()
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("shutdown blocked after streams finished")
+	}
+	waitClosed(t, client)
+	if err := s.Shutdown(context.Background()); err == nil {
+		t.Fatal("second shutdown should fail")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	s := newTestServer(t)
+	client := dialSession(t, s.sm, 1)
+	ackGoaway(client)
+	s.sm.trackStream()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitClosed(t, client)
+}
+
+func freePort(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+// TestServeListeners 所有监听都接收连接，关闭服务端后Serve返回nil
+func TestServeListeners(t *testing.T) {
+	config, err := reality.NewServerConfig("127.0.0.1:1", "127.0.0.1:"+freePort(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Listeners = []*reality.ListenerConfig{{Listen: "127.0.0.1:" + freePort(t), SNIAddr: "127.0.0.1:2"}}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t)
+	s.config = config
+	served := make(chan error, 1)
+	go func() { served <- s.Serve() }()
+	for _, l := range config.AllListeners() {
+		_, port, _ := net.SplitHostPort(l.Listen)
+		var conn net.Conn
+		for i := 0; i < 50; i++ {
+			if conn, err = net.Dial("tcp", "127.0.0.1:"+port); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("listen %s: %v", l.Listen, err)
+		}
+		conn.Close()
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("serve should return after shutdown")
+	}
+}
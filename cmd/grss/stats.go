@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/howmp/reality"
+)
+
+type stats struct {
+	ConfigPath string `short:"o" default:"config.json" description:"server config path"`
+	File       string `short:"f" description:"traffic file, default from server config"`
+}
+
+// Execute 输出流量统计文件中各用户经各客户端的流量，以及配额使用情况
+func (s *stats) Execute(args []string) error {
+	var config *reality.ServerConfig
+	file := s.File
+	if file == "" {
+		var err error
+		config, err = loadConfig(s.ConfigPath)
+		if err != nil {
+			return err
+		}
+		if config.Traffic == nil {
+			return fmt.Errorf("traffic not configured in %s", s.ConfigPath)
+		}
+		file = config.Traffic.File
+	}
+	data, err := readTraffic(file)
+	if err != nil {
+		return err
+	}
+	t := trafficFrom(file, data.Records)
+	fmt.Printf("updated: %s\n", data.Updated.Format(time.RFC3339))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "USER\tCLIENT\tTODAY UP/DOWN\tMONTH UP/DOWN\tTOTAL UP/DOWN")
+	for _, r := range t.snapshot() {
+		user := r.User
+		if user == "" {
+			user = "-"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s/%s\t%s/%s\t%s/%s\n", user, r.Client,
+			formatBytes(r.DayUpload), formatBytes(r.DayDownload),
+			formatBytes(r.MonthUpload), formatBytes(r.MonthDownload),
+			formatBytes(r.Upload), formatBytes(r.Download))
+	}
+	w.Flush()
+	if config == nil {
+		return nil
+	}
+	for _, u := range config.Users {
+		if u.DailyQuota == 0 && u.MonthlyQuota == 0 {
+			continue
+		}
+		day, month := t.usage(u.Name)
+		fmt.Printf("quota %s: today %s/%s, month %s/%s\n", u.Name,
+			formatBytes(day), formatQuota(u.DailyQuota), formatBytes(month), formatQuota(u.MonthlyQuota))
+	}
+	return nil
+}
+
+func formatQuota(n int64) string {
+	if n == 0 {
+		return "unlimited"
+	}
+	return formatBytes(n)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/howmp/reality"
+	"github.com/sirupsen/logrus"
+)
+
+// targetStatsInterval 输出模拟目标统计的间隔
+const targetStatsInterval = time.Minute
+
+// targetMonitor 记录上次输出时的计数，只输出统计周期内有失败或仍不可达的模拟目标
+type targetMonitor struct {
+	failures    map[string]uint64
+	unreachable map[string]uint64
+}
+
+func newTargetMonitor() *targetMonitor {
+	return &targetMonitor{failures: make(map[string]uint64), unreachable: make(map[string]uint64)}
+}
+
+// update 返回需要输出的目标统计，以及统计周期内因所有目标都不可达而放弃的连接数
+func (m *targetMonitor) update(listen string, targets []reality.TargetStat, unreachable uint64) ([]string, uint64) {
+	var lines []string
+	for _, t := range targets {
+		key := listen + " " + t.Addr
+		failures := t.Failures - m.failures[key]
+		m.failures[key] = t.Failures
+		if failures == 0 && t.Up {
+			continue
+		}
+		state := "up"
+		if !t.Up {
+			state = "down"
+		}
+		lines = append(lines, fmt.Sprintf("listen %s target %s %s, %d failures, %d dials, last error: %s",
+			listen, t.Addr, state, failures, t.Dials, t.LastError))
+	}
+	dropped := unreachable - m.unreachable[listen]
+	m.unreachable[listen] = unreachable
+	return lines, dropped
+}
+
+// logTargetStats 定期输出模拟目标的失败统计
+func logTargetStats(listeners []net.Listener, logger logrus.FieldLogger) {
+	m := newTargetMonitor()
+	for range time.Tick(targetStatsInterval) {
+		for _, l := range listeners {
+			rl, ok := l.(*reality.Listener)
+			if !ok {
+				continue
+			}
+			listen := l.Addr().String()
+			targets, unreachable := rl.TargetStats()
+			lines, dropped := m.update(listen, targets, unreachable)
+			for _, line := range lines {
+				logger.Warnf("camouflage %s", line)
+			}
+			if dropped > 0 {
+				logger.Errorf("listen %s dropped %d connections, all camouflage targets unreachable, clients cannot connect either", listen, dropped)
+			}
+		}
+	}
+}
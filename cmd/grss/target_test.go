@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/howmp/reality"
+)
+
+func TestTargetMonitor(t *testing.T) {
+	m := newTargetMonitor()
+	targets := []reality.TargetStat{
+		{Addr: "a.com:443", Up: true, Dials: 10},
+		{Addr: "b.com:443", Up: false, Dials: 2, Failures: 3, LastError: "refused"},
+	}
+	lines, dropped := m.update(":443", targets, 2)
+	if len(lines) != 1 || dropped != 2 {
+		t.Fatalf("lines %q, dropped %d", lines, dropped)
+	}
+
+	// 恢复后本周期没有新的失败，不再输出
+	targets[1].Up = true
+	lines, dropped = m.update(":443", targets, 2)
+	if len(lines) != 0 || dropped != 0 {
+		t.Fatalf("lines %q, dropped %d", lines, dropped)
+	}
+
+	// 可达但周期内有失败时输出
+	targets[0].Failures = 1
+	lines, _ = m.update(":443", targets, 2)
+	if len(lines) != 1 || lines[0] != "listen :443 target a.com:443 up, 1 failures, 10 dials, last error: " {
+		t.Fatalf("lines %q", lines)
+	}
+	// 不同监听分别统计
+	if _, dropped = m.update(":8443", nil, 1); dropped != 1 {
+		t.Fatalf("dropped %d", dropped)
+	}
+}
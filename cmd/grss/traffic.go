@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/howmp/reality"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultTrafficSave 默认保存间隔
+const defaultTrafficSave = time.Minute
+
+const (
+	dayLayout   = "2006-01-02"
+	monthLayout = "2006-01"
+)
+
+// trafficRecord 一个用户经一个客户端的流量，上行为用户端到客户端所在网络的方向
+type trafficRecord struct {
+	User          string `json:"user"`
+	Client        byte   `json:"client"`
+	Upload        int64  `json:"upload"`
+	Download      int64  `json:"download"`
+	Day           string `json:"day"`
+	DayUpload     int64  `json:"day_upload"`
+	DayDownload   int64  `json:"day_download"`
+	Month         string `json:"month"`
+	MonthUpload   int64  `json:"month_upload"`
+	MonthDownload int64  `json:"month_download"`
+}
+
+// roll 进入新的一天或一个月时清零对应计数
+func (r *trafficRecord) roll(now time.Time) {
+	if day := now.Format(dayLayout); r.Day != day {
+		r.Day, r.DayUpload, r.DayDownload = day, 0, 0
+	}
+	if month := now.Format(monthLayout); r.Month != month {
+		r.Month, r.MonthUpload, r.MonthDownload = month, 0, 0
+	}
+}
+
+// trafficData 统计文件内容
+type trafficData struct {
+	Updated time.Time        `json:"updated"`
+	Records []*trafficRecord `json:"records"`
+}
+
+type trafficKey struct {
+	user   string
+	client byte
+}
+
+// trafficCounter 一个用户经一个客户端的计数，连接读写只累加原子计数，
+// 读取统计时在锁内并入record
+type trafficCounter struct {
+	record   *trafficRecord
+	upload   atomic.Int64
+	download atomic.Int64
+}
+
+// flush 将未并入的计数加到record所在的日期和月份后再进入now所在的周期，调用时需持有traffic.lock
+func (c *trafficCounter) flush(now time.Time) *trafficRecord {
+	r := c.record
+	upload, download := c.upload.Swap(0), c.download.Swap(0)
+	r.Upload += upload
+	r.Download += download
+	r.DayUpload += upload
+	r.DayDownload += download
+	r.MonthUpload += upload
+	r.MonthDownload += download
+	r.roll(now)
+	return r
+}
+
+// traffic 按用户和客户端统计流量，file不为空时定期保存
+type traffic struct {
+	file     string
+	now      func() time.Time
+	lock     sync.Mutex
+	counters map[trafficKey]*trafficCounter
+}
+
+// newTraffic 从file加载已有统计，文件不存在时从零开始
+func newTraffic(file string) (*traffic, error) {
+	if file == "" {
+		return trafficFrom("", nil), nil
+	}
+	data, err := readTraffic(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return trafficFrom(file, nil), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return trafficFrom(file, data.Records), nil
+}
+
+func trafficFrom(file string, records []*trafficRecord) *traffic {
+	t := &traffic{file: file, now: time.Now, counters: make(map[trafficKey]*trafficCounter)}
+	for _, r := range records {
+		t.counters[trafficKey{r.User, r.Client}] = &trafficCounter{record: r}
+	}
+	return t
+}
+
+func readTraffic(file string) (*trafficData, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	data := &trafficData{}
+	if err := json.Unmarshal(b, data); err != nil {
+		return nil, fmt.Errorf("traffic file %s: %w", file, err)
+	}
+	return data, nil
+}
+
+// counter 返回用户经客户端的计数，不存在时创建
+func (t *traffic) counter(user string, client byte) *trafficCounter {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	key := trafficKey{user, client}
+	c, ok := t.counters[key]
+	if !ok {
+		c = &trafficCounter{record: &trafficRecord{User: user, Client: client}}
+		c.record.roll(t.now())
+		t.counters[key] = c
+	}
+	return c
+}
+
+func (t *traffic) add(user string, client byte, upload, download int64) {
+	if upload == 0 && download == 0 {
+		return
+	}
+	c := t.counter(user, client)
+	c.upload.Add(upload)
+	c.download.Add(download)
+}
+
+// usage 返回用户在所有客户端上当日和当月的上下行合计
+func (t *traffic) usage(user string) (day, month int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := t.now()
+	for key, c := range t.counters {
+		if key.user != user {
+			continue
+		}
+		r := c.flush(now)
+		day += r.DayUpload + r.DayDownload
+		month += r.MonthUpload + r.MonthDownload
+	}
+	return day, month
+}
+
+// quotaExceeded 用户超过当日或当月配额时返回错误
+func (t *traffic) quotaExceeded(u *reality.UserConfig) error {
+	if u == nil || (u.DailyQuota == 0 && u.MonthlyQuota == 0) {
+		return nil
+	}
+	day, month := t.usage(u.Name)
+	if u.DailyQuota > 0 && day >= u.DailyQuota {
+		return fmt.Errorf("daily quota exceeded (%s/%s)", formatBytes(day), formatBytes(u.DailyQuota))
+	}
+	if u.MonthlyQuota > 0 && month >= u.MonthlyQuota {
+		return fmt.Errorf("monthly quota exceeded (%s/%s)", formatBytes(month), formatBytes(u.MonthlyQuota))
+	}
+	return nil
+}
+
+// snapshot 返回按用户和客户端排序的统计副本
+func (t *traffic) snapshot() []*trafficRecord {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := t.now()
+	records := make([]*trafficRecord, 0, len(t.counters))
+	for _, c := range t.counters {
+		r := *c.flush(now)
+		records = append(records, &r)
+	}
+	sortRecords(records)
+	return records
+}
+
+func sortRecords(records []*trafficRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].User != records[j].User {
+			return records[i].User < records[j].User
+		}
+		return records[i].Client < records[j].Client
+	})
+}
+
+// save 先写临时文件再替换，避免保存中断时损坏统计文件
+func (t *traffic) save() error {
+	if t.file == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(&trafficData{Updated: t.now(), Records: t.snapshot()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := t.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.file)
+}
+
+func (t *traffic) saveLoop(interval time.Duration, logger logrus.FieldLogger) {
+	if t.file == "" {
+		return
+	}
+	for range time.Tick(interval) {
+		if err := t.save(); err != nil {
+			logger.Errorf("save traffic: %v", err)
+		}
+	}
+}
+
+// countedConn 统计用户侧连接的流量，读为上行，写为下行，counter为nil时只统计该连接
+type countedConn struct {
+	net.Conn
+	counter  *trafficCounter
+	upload   int64
+	download int64
+}
+
+// countUser 打开流时查找一次用户计数，之后的读写不再加锁
+func (t *traffic) countUser(conn net.Conn, user string, client byte) *countedConn {
+	return &countedConn{Conn: conn, counter: t.counter(user, client)}
+}
+
+func (c *countedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.upload, int64(n))
+	if c.counter != nil {
+		c.counter.upload.Add(int64(n))
+	}
+	return n, err
+}
+
+func (c *countedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.download, int64(n))
+	if c.counter != nil {
+		c.counter.download.Add(int64(n))
+	}
+	return n, err
+}
+
+// uploaded 返回该连接的上行字节数
+func (c *countedConn) uploaded() int64 {
+	return atomic.LoadInt64(&c.upload)
+}
+
+func (c *countedConn) downloaded() int64 {
+	return atomic.LoadInt64(&c.download)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	value, suffix := float64(n), ""
+	for _, s := range []string{"KB", "MB", "GB", "TB"} {
+		value /= unit
+		suffix = s
+		if value < unit {
+			break
+		}
+	}
+	return fmt.Sprintf("%.1f%s", value, suffix)
+}
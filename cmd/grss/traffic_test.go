@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/howmp/reality"
+)
+
+func TestTrafficQuota(t *testing.T) {
+	now := time.Date(2024, 1, 31, 23, 0, 0, 0, time.Local)
+	tr := trafficFrom("", nil)
+	tr.now = func() time.Time { return now }
+	alice := &reality.UserConfig{Name: "alice", DailyQuota: 1000, MonthlyQuota: 1500}
+	tr.add("alice", 1, 300, 400)
+	tr.add("alice", 2, 100, 100)
+	tr.add("bob", 1, 5000, 0)
+	if day, month := tr.usage("alice"); day != 900 || month != 900 {
+		t.Fatalf("usage %d %d", day, month)
+	}
+	if err := tr.quotaExceeded(alice); err != nil {
+		t.Fatal(err)
+	}
+	tr.add("alice", 1, 100, 0)
+	if err := tr.quotaExceeded(alice); err == nil {
+		t.Fatal("daily quota should be exceeded")
+	}
+
+	// 进入新的一天和新的一个月后对应计数清零，累计不变
+	now = now.Add(2 * time.Hour)
+	if err := tr.quotaExceeded(alice); err != nil {
+		t.Fatal(err)
+	}
+	records := tr.snapshot()
+	if len(records) != 3 || records[0].User != "alice" || records[0].Client != 1 || records[0].Upload != 400 || records[0].DayUpload != 0 {
+		t.Fatalf("records %+v", records[0])
+	}
+}
+
+func TestTrafficSave(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "traffic.json")
+	tr, err := newTraffic(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, userConn := net.Pipe()
+	counted := tr.countUser(serverConn, "alice", 3)
+	go func() {
+		userConn.Write([]byte("hello"))
+		io.ReadFull(userConn, make([]byte, 2))
+		userConn.Close()
+	}()
+	if _, err := io.ReadFull(counted, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	counted.Write([]byte("ok"))
+	if err := tr.save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := newTraffic(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := loaded.snapshot()
+	if len(records) != 1 || records[0].Upload != 5 || records[0].Download != 2 || records[0].MonthUpload != 5 {
+		t.Fatalf("records %+v", records)
+	}
+}
+
+// TestTrafficConcurrent 多个流并发读写时统计不丢失，读写期间可以查询用量
+func TestTrafficConcurrent(t *testing.T) {
+	tr := trafficFrom("", nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		serverConn, userConn := net.Pipe()
+		counted := tr.countUser(serverConn, "alice", byte(i%2))
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				userConn.Write([]byte("up"))
+			}
+			userConn.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			io.Copy(io.Discard, counted)
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for {
+		tr.usage("alice")
+		select {
+		case <-done:
+			if day, month := tr.usage("alice"); day != 1600 || month != 1600 {
+				t.Fatalf("usage %d %d", day, month)
+			}
+			return
+		default:
+		}
+	}
+}
+
+// TestTrafficRollFlush 跨过零点和月末后才并入的计数仍属于计数时的日期和月份
+func TestTrafficRollFlush(t *testing.T) {
+	now := time.Date(2024, 1, 31, 23, 59, 0, 0, time.Local)
+	tr := trafficFrom("", nil)
+	tr.now = func() time.Time { return now }
+	tr.add("alice", 1, 100, 200)
+	now = now.Add(2 * time.Minute)
+	if day, month := tr.usage("alice"); day != 0 || month != 0 {
+		t.Fatalf("usage %d %d after midnight", day, month)
+	}
+	tr.add("alice", 1, 10, 0)
+	records := tr.snapshot()
+	if r := records[0]; r.Upload != 110 || r.Download != 200 || r.DayUpload != 10 || r.MonthUpload != 10 || r.Day != "2024-02-01" {
+		t.Fatalf("record %+v", r)
+	}
+}
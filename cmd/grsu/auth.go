@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// credential 本地代理的用户，id为-1时按路由选择客户端
+type credential struct {
+	password string
+	id       int
+}
+
+// credentials 本地代理的用户，为空时不需要认证
+type credentials map[string]*credential
+
+func (c credentials) String() string {
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// Set 解析-auth参数 user:password[:id]
+func (c credentials) Set(s string) error {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return fmt.Errorf("invalid auth %q, want user:password[:id]", s)
+	}
+	return c.add(parts[0], parts[1], parts[2:])
+}
+
+func (c credentials) add(user, password string, id []string) error {
+	if user == "" || password == "" || len(user) > 255 || len(password) > 255 {
+		return fmt.Errorf("invalid user %q", user)
+	}
+	if _, ok := c[user]; ok {
+		return fmt.Errorf("duplicate user %q", user)
+	}
+	cred := &credential{password: password, id: -1}
+	if len(id) == 1 {
+		v, err := strconv.ParseUint(id[0], 10, 8)
+		if err != nil || v >= 128 {
+			return fmt.Errorf("invalid user %q id %q", user, id[0])
+		}
+		cred.id = int(v)
+	}
+	c[user] = cred
+	return nil
+}
+
+// load 从文件加载用户，每行"user password [id]"，#开头为注释
+func (c credentials) load(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 2 || len(fields) > 3 {
+			return fmt.Errorf("%s line %d: want user password [id]", file, line)
+		}
+		if err := c.add(fields[0], fields[1], fields[2:]); err != nil {
+			return fmt.Errorf("%s line %d: %w", file, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// check 校验用户名密码，失败时返回nil
+func (c credentials) check(user, password string) *credential {
+	cred, ok := c[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(cred.password), []byte(password)) != 1 {
+		return nil
+	}
+	return cred
+}
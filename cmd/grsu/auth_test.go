@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/armon/go-socks5"
+	"github.com/howmp/reality"
+	"github.com/howmp/reality/cmd"
+)
+
+func TestCredentials(t *testing.T) {
+	users := credentials{}
+	if err := users.Set("alice:secret"); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "users.txt")
+	if err := os.WriteFile(file, []byte("# 注释\nbob pass 3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.load(file); err != nil {
+		t.Fatal(err)
+	}
+	if cred := users.check("alice", "secret"); cred == nil || cred.id != -1 {
+		t.Fatal("alice should pass")
+	}
+	if cred := users.check("bob", "pass"); cred == nil || cred.id != 3 {
+		t.Fatal("bob should pass with id 3")
+	}
+	if users.check("alice", "wrong") != nil || users.check("carol", "") != nil {
+		t.Fatal("should fail")
+	}
+	for _, v := range []string{"alice:again", "eve", "eve:pass:128", ":pass"} {
+		if err := users.Set(v); err == nil {
+			t.Fatalf("%s should be invalid", v)
+		}
+	}
+}
+
+// socksAuth 使用用户名密码认证，返回认证结果
+func socksAuth(t *testing.T, addr net.Addr, user, password string) (net.Conn, byte) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	req := append([]byte{5, 1, 2, 1, byte(len(user))}, user...)
+	req = append(append(req, byte(len(password))), password...)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	return conn, reply[3]
+}
+
+func TestSocksAuth(t *testing.T) {
+	targetAddr := startEcho(t)
+	users := credentials{}
+	users.Set("alice:secret")
+	addr := startProxy(t, &proxy{s: startClient(t), users: users, logger: reality.GetLogger(false)})
+
+	if _, status := socksAuth(t, addr, "alice", "wrong"); status == 0 {
+		t.Fatal("wrong password should fail")
+	}
+
+	// 不提供认证方法时拒绝
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{5, 1, 0})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0xff {
+		t.Fatalf("no auth should be rejected, got %v", reply)
+	}
+
+	conn, status := socksAuth(t, addr, "alice", "secret")
+	if status != 0 {
+		t.Fatalf("auth status %d", status)
+	}
+	if _, err := conn.Write(cmd.AppendAddr([]byte{5, 1, 0}, &socks5.AddrSpec{IP: targetAddr.IP, Port: targetAddr.Port})); err != nil {
+		t.Fatal(err)
+	}
+	hdr := make([]byte, 3)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		t.Fatal(err)
+	}
+	if hdr[1] != cmd.SocksReplySuccess {
+		t.Fatalf("socks5 reply %d", hdr[1])
+	}
+	if _, err := cmd.ReadAddr(conn); err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, conn)
+}
+
+func TestHTTPAuth(t *testing.T) {
+	users := credentials{}
+	users.Set("alice:secret")
+	addr := startProxy(t, &proxy{s: startClient(t), users: users, logger: reality.GetLogger(false)})
+	for _, u := range []*url.Userinfo{nil, url.UserPassword("alice", "wrong")} {
+		proxyURL := &url.URL{Scheme: "http", Host: addr.String(), User: u}
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		resp, err := client.Get("http://127.0.0.1:1/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			t.Fatalf("status %d", resp.StatusCode)
+		}
+	}
+}
+
+func TestUserRoute(t *testing.T) {
+	users := credentials{}
+	users.Set("bob:pass:3")
+	var created []byte
+	pool := newSessionPool(func(id byte) *serverSession {
+		created = append(created, id)
+		return startClient(t)
+	})
+	p := &proxy{s: startClient(t), pool: pool, users: users, logger: reality.GetLogger(false)}
+	if p.route("bob", nil) != pool.get(3) || p.route("alice", nil) != p.s {
+		t.Fatal("wrong session")
+	}
+	if string(created) != string([]byte{3}) {
+		t.Fatalf("sessions %v", created)
+	}
+}
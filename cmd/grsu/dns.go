@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/howmp/reality/cmd"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsIdleTimeout TCP查询连接的空闲超时
+const dnsIdleTimeout = 30 * time.Second
+
+// dnsRetryInterval 接收连接出现临时错误后的重试间隔
+const dnsRetryInterval = 100 * time.Millisecond
+
+// serveDNS 本地DNS服务，同时监听UDP和TCP，查询经客户端解析
+func (p *proxy) serveDNS(addr string) {
+	p.localDNS = cmd.NewDNSForwarder(&cmd.Resolver{})
+	udpConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		p.logger.Fatalf("dns listen: %v", err)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		p.logger.Fatalf("dns listen: %v", err)
+	}
+	p.logger.Infof("dns listen %s", addr)
+	go p.acceptDNS(l)
+	p.readDNS(udpConn)
+}
+
+// acceptDNS 接收TCP查询连接，监听关闭或出现非临时错误时返回
+func (p *proxy) acceptDNS(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !isTemporary(err) {
+				p.logger.Errorf("dns accept: %v, stop", err)
+				return
+			}
+			p.logger.Errorf("dns accept: %v", err)
+			time.Sleep(dnsRetryInterval)
+			continue
+		}
+		go p.handleDNSConn(conn)
+	}
+}
+
+// readDNS 读取UDP查询，单个数据报的错误不影响后续查询，连接关闭时返回
+func (p *proxy) readDNS(udpConn net.PacketConn) {
+	buf := make([]byte, 0xFFFF)
+	for {
+		n, from, err := udpConn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				p.logger.Errorf("dns read: %v, stop", err)
+				return
+			}
+			p.logger.Errorf("dns read: %v", err)
+			continue
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			resp, err := p.exchangeDNS(query)
+			if err != nil {
+				p.logger.Errorf("dns %s: %v", from, err)
+			}
+			if resp != nil {
+				udpConn.WriteTo(resp, from)
+			}
+		}()
+	}
+}
+
+// isTemporary 监听出现的错误是否可以重试，监听已关闭时返回false
+func isTemporary(err error) bool {
+	var te interface{ Temporary() bool }
+	return !errors.Is(err, net.ErrClosed) && errors.As(err, &te) && te.Temporary()
+}
+
+func (p *proxy) handleDNSConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetReadDeadline(time.Now().Add(dnsIdleTimeout))
+		query, err := cmd.ReadDNSMessage(conn)
+		if err != nil {
+			return
+		}
+		resp, err := p.exchangeDNS(query)
+		if err != nil {
+			p.logger.Errorf("dns %s: %v", conn.RemoteAddr(), err)
+		}
+		if resp == nil {
+			return
+		}
+		if err := cmd.WriteDNSMessage(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+// exchangeDNS 按查询的域名选择客户端，直连时在本地解析
+func (p *proxy) exchangeDNS(query []byte) ([]byte, error) {
+	var parser dnsmessage.Parser
+	if _, err := parser.Start(query); err != nil {
+		return nil, err
+	}
+	q, err := parser.Question()
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSuffix(q.Name.String(), ".")
+	p.logger.Debugf("dns query %s %s", name, q.Type)
+	s := p.route("", &socks5.AddrSpec{FQDN: name})
+	if s == nil {
+		return p.localDNS.Exchange(context.Background(), query)
+	}
+	stream, err := s.openStream(cmd.StreamDNS)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(cmd.DNSTimeout * 2))
+	if err := cmd.WriteDNSMessage(stream, query); err != nil {
+		return nil, err
+	}
+	return cmd.ReadDNSMessage(stream)
+}
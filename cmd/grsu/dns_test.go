@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/howmp/reality"
+	"github.com/howmp/reality/cmd"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDNS(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.LocalAddr().String()
+	l.Close()
+	p := &proxy{s: startClient(t), logger: reality.GetLogger(false)}
+	go p.serveDNS(addr)
+	time.Sleep(100 * time.Millisecond)
+
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 1, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName("localhost."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, network := range []string{"udp", "tcp"} {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(3 * time.Second))
+		var resp []byte
+		if network == "udp" {
+			conn.Write(query)
+			buf := make([]byte, 0xFFFF)
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp = buf[:n]
+		} else {
+			if err := cmd.WriteDNSMessage(conn, query); err != nil {
+				t.Fatal(err)
+			}
+			if resp, err = cmd.ReadDNSMessage(conn); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var answer dnsmessage.Message
+		if err := answer.Unpack(resp); err != nil {
+			t.Fatal(err)
+		}
+		if answer.Header.ID != 1 || len(answer.Answers) == 0 {
+			t.Fatalf("%s: %+v", network, answer)
+		}
+		if a := answer.Answers[0].Body.(*dnsmessage.AResource).A; a != [4]byte{127, 0, 0, 1} {
+			t.Fatalf("%s: got %v", network, a)
+		}
+	}
+}
+
+// TestDNSClosed 监听关闭后接收和读取循环返回，不会持续出错
+func TestDNSClosed(t *testing.T) {
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &proxy{logger: reality.GetLogger(false)}
+	done := make(chan struct{}, 2)
+	go func() {
+		p.acceptDNS(l)
+		done <- struct{}{}
+	}()
+	go func() {
+		p.readDNS(udpConn)
+		done <- struct{}{}
+	}()
+	l.Close()
+	udpConn.Close()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("dns loop should stop after close")
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/armon/go-socks5"
+	"github.com/howmp/reality/cmd"
+)
+
+// forward 静态端口转发，本地监听地址的连接经客户端转发到固定目标
+type forward struct {
+	listen string
+	target *socks5.AddrSpec
+}
+
+// forwardFlags 可重复指定的-L参数
+type forwardFlags []*forward
+
+func (f *forwardFlags) String() string {
+	forwards := make([]string, 0, len(*f))
+	for _, v := range *f {
+		forwards = append(forwards, v.listen+"->"+v.target.Address())
+	}
+	return strings.Join(forwards, ",")
+}
+
+// Set 解析[bind_address:]port:host:hostport，IPv6地址需要用[]包裹
+func (f *forwardFlags) Set(s string) error {
+	parts := splitForward(s)
+	var listen, target string
+	switch len(parts) {
+	case 3:
+		listen, target = net.JoinHostPort("127.0.0.1", parts[0]), net.JoinHostPort(parts[1], parts[2])
+	case 4:
+		listen, target = net.JoinHostPort(parts[0], parts[1]), net.JoinHostPort(parts[2], parts[3])
+	default:
+		return fmt.Errorf("invalid forward %q, want [bind_address:]port:host:hostport", s)
+	}
+	addr, err := cmd.ParseAddr(target)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, &forward{listen: listen, target: addr})
+	return nil
+}
+
+// splitForward 按:拆分，忽略[]内的:
+func splitForward(s string) []string {
+	var parts []string
+	start, inBracket := 0, false
+	for i, c := range s {
+		switch c {
+		case '[':
+			inBracket = true
+		case ']':
+			inBracket = false
+		case ':':
+			if !inBracket {
+				parts = append(parts, strings.Trim(s[start:i], "[]"))
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, strings.Trim(s[start:], "[]"))
+}
+
+// serveForward 监听本地端口，每个连接打开端口转发流
+func (p *proxy) serveForward(f *forward) {
+	l, err := net.Listen("tcp", f.listen)
+	if err != nil {
+		p.logger.Fatalf("forward listen: %v", err)
+	}
+	p.logger.Infof("forward %s -> %s", f.listen, f.target.Address())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			p.logger.Errorf("forward accept: %v", err)
+			continue
+		}
+		go p.handleForward(conn, f.target)
+	}
+}
+
+func (p *proxy) handleForward(conn net.Conn, target *socks5.AddrSpec) {
+	defer conn.Close()
+	var stream net.Conn
+	var err error
+	if s := p.route("", target); s != nil {
+		stream, err = openForward(s, target)
+	} else {
+		stream, _, _, err = dialDirect(target)
+	}
+	if err != nil {
+		p.logger.Errorf("forward %s: %v", target.Address(), err)
+		return
+	}
+	defer stream.Close()
+	go io.Copy(stream, conn)
+	io.Copy(conn, stream)
+}
+
+// openForward 打开端口转发流，等待客户端连接目标
+func openForward(s *serverSession, target *socks5.AddrSpec) (net.Conn, error) {
+	stream, err := s.openStream(cmd.StreamForward)
+	if err != nil {
+		return nil, fmt.Errorf("open session stream: %w", err)
+	}
+	if err := cmd.WriteForward(stream, target); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if err := cmd.ReadForwardReply(stream); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/howmp/reality/cmd"
+)
+
+// hopHeaders 逐跳头部，转发前需要删除
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders 删除逐跳头部，以及Connection中列出的头部(RFC 7230 6.1)
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// handleHTTPUser 独立HTTP代理端口上的连接
+func (p *proxy) handleHTTPUser(conn net.Conn) {
+	defer conn.Close()
+	p.handleHTTP(newBufferedConn(conn))
+}
+
+// handleHTTP HTTP代理，CONNECT和绝对URI请求都转换为socks5请求交给客户端处理
+func (p *proxy) handleHTTP(conn *bufferedConn) {
+	var tunnel net.Conn
+	var tunnelReader *bufio.Reader
+	var tunnelHost, tunnelUser string
+	defer func() {
+		if tunnel != nil {
+			tunnel.Close()
+		}
+	}()
+	for {
+		req, err := http.ReadRequest(conn.r)
+		if err != nil {
+			if err != io.EOF {
+				p.logger.Errorf("http %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		user, password := proxyUser(req)
+		if len(p.users) != 0 && p.users.check(user, password) == nil {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"grsu\"\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+			if user != "" {
+				p.logger.Warnf("http %s: user(%s) auth failed", conn.RemoteAddr(), user)
+			}
+			return
+		}
+		if req.Method == http.MethodConnect {
+			p.handleHTTPConnect(conn, user, req)
+			return
+		}
+		if req.URL.Scheme != "http" || req.URL.Host == "" {
+			writeHTTPError(conn, http.StatusBadRequest)
+			p.logger.Errorf("http %s: unsupported url %s", conn.RemoteAddr(), req.URL)
+			return
+		}
+		host := req.URL.Host
+		if req.URL.Port() == "" {
+			host = net.JoinHostPort(strings.Trim(host, "[]"), "80")
+		}
+		// 同一连接上目标不变时复用到客户端的流
+		if tunnel == nil || tunnelHost != host || tunnelUser != user {
+			if tunnel != nil {
+				tunnel.Close()
+				tunnel = nil
+			}
+			stream, err := p.dialHTTP(user, host)
+			if err != nil {
+				writeHTTPError(conn, httpStatus(err))
+				p.logger.Errorf("http %s: %v", req.URL, err)
+				return
+			}
+			tunnel, tunnelReader, tunnelHost, tunnelUser = stream, bufio.NewReader(stream), host, user
+		}
+		p.logger.Infof("http user(%s) %s %s %s", user, conn.RemoteAddr(), req.Method, req.URL)
+		removeHopHeaders(req.Header)
+		if err := req.Write(tunnel); err != nil {
+			p.logger.Errorf("http %s: %v", req.URL, err)
+			return
+		}
+		resp, err := http.ReadResponse(tunnelReader, req)
+		if err != nil {
+			writeHTTPError(conn, http.StatusBadGateway)
+			p.logger.Errorf("http %s: %v", req.URL, err)
+			return
+		}
+		removeHopHeaders(resp.Header)
+		err = resp.Write(conn)
+		resp.Body.Close()
+		if err != nil || req.Close || resp.Close {
+			return
+		}
+	}
+}
+
+// handleHTTPConnect 隧道建立后直接转发
+func (p *proxy) handleHTTPConnect(conn *bufferedConn, user string, req *http.Request) {
+	stream, err := p.dialHTTP(user, req.Host)
+	if err != nil {
+		writeHTTPError(conn, httpStatus(err))
+		p.logger.Errorf("http connect %s: %v", req.Host, err)
+		return
+	}
+	defer stream.Close()
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	p.logger.Infof("http user(%s) %s connect %s", user, conn.RemoteAddr(), req.Host)
+	go io.Copy(stream, conn)
+	io.Copy(conn, stream)
+}
+
+// proxyUser 从Proxy-Authorization中取出用户名密码
+func proxyUser(req *http.Request) (string, string) {
+	auth := req.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		return "", ""
+	}
+	user, password, _ := (&http.Request{Header: http.Header{"Authorization": {auth}}}).BasicAuth()
+	return user, password
+}
+
+// replyError 客户端返回的socks5错误回复
+type replyError byte
+
+func (e replyError) Error() string {
+	return fmt.Sprintf("socks5 reply %d", byte(e))
+}
+
+func (p *proxy) dialHTTP(user, host string) (net.Conn, error) {
+	addr, err := cmd.ParseAddr(host)
+	if err != nil {
+		return nil, err
+	}
+	stream, reply, _, err := p.dialConnect(user, addr)
+	if err != nil && reply != cmd.SocksReplyServerFailure {
+		return nil, replyError(reply)
+	}
+	return stream, err
+}
+
+// httpStatus 被规则拒绝时返回403，其余返回502
+func httpStatus(err error) int {
+	if e, ok := err.(replyError); ok && e == cmd.SocksReplyRuleFailure {
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
+
+func writeHTTPError(w io.Writer, code int) error {
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", code, http.StatusText(code))
+	return err
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/howmp/reality"
+)
+
+func TestHTTPConnect(t *testing.T) {
+	targetAddr := startEcho(t)
+
+	// socks5端口上自动识别HTTP代理请求
+	addr := startProxy(t, &proxy{s: startClient(t), logger: reality.GetLogger(false)})
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", targetAddr, targetAddr)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	checkEcho(t, conn)
+}
+
+func TestHTTPProxy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Connection") != "" || r.Header.Get("X-Hop") != "" {
+			t.Error("hop header should be removed")
+		}
+		if r.Header.Get("X-End") == "" {
+			t.Error("end-to-end header should be kept")
+		}
+		w.Header().Set("Connection", "X-Resp-Hop")
+		w.Header().Set("X-Resp-Hop", "1")
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer server.Close()
+
+	addr := startProxy(t, &proxy{s: startClient(t), logger: reality.GetLogger(false)})
+	proxyURL, _ := url.Parse("http://" + addr.String())
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	defer client.CloseIdleConnections()
+	for _, path := range []string{"/a", "/b"} {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		req.Header.Set("Proxy-Connection", "keep-alive")
+		req.Header.Set("Connection", "keep-alive, X-Hop")
+		req.Header.Set("X-Hop", "1")
+		req.Header.Set("X-End", "1")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Header.Get("X-Resp-Hop") != "" {
+			t.Error("response hop header should be removed")
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != path {
+			t.Fatalf("got %q, want %q", body, path)
+		}
+	}
+
+	// 无法连接的目标返回502
+	resp, err := client.Get("http://127.0.0.1:1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+}
@@ -1,114 +1,434 @@
-package main
-
-import (
-	"context"
-	"errors"
-	"flag"
-	"io"
-	"net"
-	"time"
-
-	"github.com/hashicorp/yamux"
-	"github.com/howmp/reality"
-	"github.com/howmp/reality/cmd"
-	"github.com/sirupsen/logrus"
-)
-
-type serverSession struct {
-	config  *reality.ClientConfig
-	session *yamux.Session
-	logger  logrus.FieldLogger
-}
-
-func newServerSession(config *reality.ClientConfig, logger logrus.FieldLogger) *serverSession {
-	return &serverSession{
-		config: config,
-		logger: logger,
-	}
-}
-
-func (s *serverSession) connectForever() {
-
-	for {
-		s.connect()
-		s.logger.Infoln("sleep 5s")
-		time.Sleep(time.Second * 5)
-	}
-
-}
-func (s *serverSession) connect() {
-	logger := s.logger
-	client, err := reality.NewClient(context.Background(), s.config)
-	if err != nil {
-		logger.Errorf("connect server: %v", err)
-		return
-	}
-	defer client.Close()
-	session, err := yamux.Server(client, nil)
-	if err != nil {
-		logger.Errorf("yamux: %v", err)
-		return
-	}
-	defer session.Close()
-	s.session = session
-	logger.Infof("session opened %s", client.RemoteAddr())
-	<-session.CloseChan()
-	logger.Infof("session closed %s", client.RemoteAddr())
-}
-
-func (s *serverSession) openSessionStream() (*yamux.Stream, error) {
-
-	if s.session != nil {
-		stream, err := s.session.OpenStream()
-		if err != nil {
-			s.session.Close()
-			s.session = nil
-			return nil, err
-		}
-		return stream, nil
-	}
-	return nil, errors.New("session not open")
-}
-
-func main() {
-	config, err := reality.UnmarshalClientConfig(cmd.ConfigDataPlaceholder)
-	if err != nil {
-		println(err.Error())
-		return
-	}
-	logger := reality.GetLogger(config.Debug)
-	addr := flag.String("l", "127.0.0.1:61080", "socks5 listen address")
-	id := flag.Uint("i", 0, "id")
-	flag.Parse()
-	logger.Infof("server addr: %s, sni: %s, id: %d", config.ServerAddr, config.SNI, byte(*id))
-	config.OverlayData = cmd.NewShortID(false, byte(*id))
-	l, err := net.Listen("tcp", *addr)
-	if err != nil {
-		logger.Panic(err)
-	}
-	logger.Infof("listen %s", *addr)
-	s := newServerSession(config, logger)
-	go s.connectForever()
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			logger.Errorf("accept: %v", err)
-			continue
-		}
-		go handleUser(conn, s, logger)
-	}
-}
-
-func handleUser(conn net.Conn, s *serverSession, logger logrus.FieldLogger) {
-	defer conn.Close()
-
-	stream, err := s.openSessionStream()
-	if err != nil {
-		logger.Errorf("open session stream: %v", err)
-		return
-	}
-	defer stream.Close()
-
-	go io.Copy(stream, conn)
-	io.Copy(conn, stream)
-}
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/howmp/reality"
+	"github.com/howmp/reality/cmd"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultWaitTimeout 重连期间打开流等待会话建立的默认超时
+const defaultWaitTimeout = 10 * time.Second
+
+var (
+	errSessionTimeout = errors.New("wait session timeout")
+	errSessionStopped = errors.New("session stopped")
+)
+
+type serverSession struct {
+	config      *reality.ClientConfig
+	logger      logrus.FieldLogger
+	user        string
+	password    string
+	connector   *cmd.Connector
+	backoff     *cmd.Backoff
+	waitTimeout time.Duration
+	ctx         context.Context // stop后取消，不再重连
+	cancel      context.CancelFunc
+
+	lock    sync.Mutex
+	session cmd.Mux
+	ready   chan struct{} // 会话建立后关闭，会话断开后重新创建
+	goaway  chan struct{} // 服务端通知即将关闭时关闭
+}
+
+func newServerSession(config *reality.ClientConfig, logger logrus.FieldLogger, user, password string) *serverSession {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &serverSession{
+		config:      config,
+		logger:      logger,
+		user:        user,
+		password:    password,
+		connector:   &cmd.Connector{Config: config, Logger: logger},
+		backoff:     &cmd.Backoff{Min: cmd.DefaultReconnectMin, Max: cmd.DefaultReconnectMax},
+		waitTimeout: defaultWaitTimeout,
+		ctx:         ctx,
+		cancel:      cancel,
+		ready:       make(chan struct{}),
+	}
+}
+
+// connectForever 断开后按退避重连，stop后返回
+func (s *serverSession) connectForever() {
+
+	for s.ctx.Err() == nil {
+		if s.connect() {
+			// 服务端即将关闭，立即连接其他地址
+			continue
+		}
+		interval := s.backoff.Next()
+		s.logger.Infof("sleep %s", interval)
+		select {
+		case <-time.After(interval):
+		case <-s.ctx.Done():
+		}
+	}
+	s.logger.Infof("session stopped")
+
+}
+
+// stop 停止重连并关闭当前会话，等待中的连接返回errSessionStopped
+func (s *serverSession) stop() {
+	s.cancel()
+	s.lock.Lock()
+	session := s.session
+	s.lock.Unlock()
+	if session != nil {
+		session.Close()
+	}
+}
+
+// dial 连接服务端并完成认证
+func (s *serverSession) dial() (net.Conn, *reality.Endpoint, error) {
+	client, endpoint, err := s.connector.Connect(s.ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("connect server: %w", err)
+	}
+	if err := cmd.WriteAuth(client, s.user, s.password); err != nil {
+		client.Close()
+		return nil, nil, fmt.Errorf("auth: %w", err)
+	}
+	if err := cmd.ReadAuthResult(client); err != nil {
+		client.Close()
+		return nil, nil, fmt.Errorf("auth: %w", err)
+	}
+	return client, endpoint, nil
+}
+
+// connect 建立会话并等待其关闭，服务端通知即将关闭时返回true
+func (s *serverSession) connect() bool {
+	logger := s.logger
+	if !s.config.Mux.Multiplexed() {
+		s.connectPerStream()
+		return false
+	}
+	client, endpoint, err := s.dial()
+	if err != nil {
+		logger.Error(err)
+		return false
+	}
+	session, err := cmd.NewMuxSession(client, s.config.Mux, false)
+	if err != nil {
+		logger.Errorf("yamux: %v", err)
+		client.Close()
+		return false
+	}
+	goaway := s.setSession(session)
+	s.backoff.Reset()
+	logger.Infof("session opened %s", endpoint)
+	select {
+	case <-session.CloseChan():
+		s.clearSession(session)
+		client.Close()
+		logger.Infof("session closed %s", endpoint)
+		return false
+	case <-s.ctx.Done():
+		session.Close()
+		s.clearSession(session)
+		client.Close()
+		return false
+	case <-goaway:
+		// 已有的流在旧会话上继续完成
+		logger.Infof("server %s going away, reconnect", endpoint)
+		s.connector.Skip()
+		go func() {
+			cmd.CloseWhenIdle(session, time.Second)
+			client.Close()
+		}()
+		return true
+	}
+}
+
+// connectPerStream none模式下每个流单独连接服务端，打开流失败时会话关闭并按退避重建
+func (s *serverSession) connectPerStream() {
+	session := cmd.NewDialMux(nil, func(byte) (net.Conn, error) {
+		conn, _, err := s.dial()
+		if err != nil {
+			return nil, err
+		}
+		s.backoff.Reset()
+		return conn, nil
+	}, 0, s.config.Mux)
+	s.setSession(session)
+	defer s.clearSession(session)
+	s.logger.Infof("session opened, one connection per stream")
+	select {
+	case <-session.CloseChan():
+	case <-s.ctx.Done():
+		session.Close()
+	}
+	s.logger.Infof("session closed")
+}
+
+// setSession 会话建立后唤醒等待的连接，返回该会话的goaway通道
+func (s *serverSession) setSession(session cmd.Mux) chan struct{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.session = session
+	s.goaway = make(chan struct{})
+	close(s.ready)
+	return s.goaway
+}
+
+// clearSession 只清除仍是当前的会话
+func (s *serverSession) clearSession(session cmd.Mux) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.session != session {
+		return
+	}
+	s.session = nil
+	s.ready = make(chan struct{})
+}
+
+// goAway 服务端不再接收新流，清除会话并通知connect重连，会话上已有的流不受影响
+func (s *serverSession) goAway(session cmd.Mux) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.session != session {
+		return
+	}
+	s.session = nil
+	s.ready = make(chan struct{})
+	close(s.goaway)
+}
+
+// openSessionStream 会话断开时等待重连，打开失败时关闭该会话并继续等待，直到超时
+func (s *serverSession) openSessionStream() (net.Conn, error) {
+	timer := time.NewTimer(s.waitTimeout)
+	defer timer.Stop()
+	var lastErr error
+	for {
+		s.lock.Lock()
+		session, ready := s.session, s.ready
+		s.lock.Unlock()
+		if session != nil {
+			stream, err := session.Open()
+			if err == nil {
+				return stream, nil
+			}
+			lastErr = err
+			if cmd.IsGoAway(err) {
+				s.goAway(session)
+				continue
+			}
+			session.Close()
+			s.clearSession(session)
+			continue
+		}
+		select {
+		case <-ready:
+		case <-s.ctx.Done():
+			return nil, errSessionStopped
+		case <-timer.C:
+			if lastErr != nil {
+				return nil, fmt.Errorf("%w: %v", errSessionTimeout, lastErr)
+			}
+			return nil, errSessionTimeout
+		}
+	}
+}
+
+// sessionPool 每个id保持一个到服务端的连接
+type sessionPool struct {
+	lock       sync.Mutex
+	sessions   map[byte]*serverSession
+	pinned     map[byte]bool // 用户指定的id，始终保留
+	newSession func(id byte) *serverSession
+}
+
+func newSessionPool(newSession func(id byte) *serverSession) *sessionPool {
+	return &sessionPool{sessions: make(map[byte]*serverSession), pinned: make(map[byte]bool), newSession: newSession}
+}
+
+// pin retain时始终保留这些id的连接
+func (p *sessionPool) pin(id byte) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.pinned[id] = true
+}
+
+// retain 停止并移除不在ids中且未pin的连接
+func (p *sessionPool) retain(ids map[byte]bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for id, s := range p.sessions {
+		if !ids[id] && !p.pinned[id] {
+			s.logger.Infof("client(id:%d) no longer used, stop", id)
+			s.stop()
+			delete(p.sessions, id)
+		}
+	}
+}
+
+// get 返回id对应的连接，不存在时创建
+func (p *sessionPool) get(id byte) *serverSession {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	s, ok := p.sessions[id]
+	if !ok {
+		s = p.newSession(id)
+		p.sessions[id] = s
+	}
+	return s
+}
+
+// openStream 打开流并发送流类型
+func (s *serverSession) openStream(streamType byte) (net.Conn, error) {
+	stream, err := s.openSessionStream()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.WriteStreamType(stream, streamType); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+func main() {
+	config, err := reality.UnmarshalClientConfig(cmd.ConfigDataPlaceholder)
+	if err != nil {
+		println(err.Error())
+		return
+	}
+	addr := flag.String("l", "127.0.0.1:61080", "socks5 and http proxy listen address, empty to disable")
+	httpAddr := flag.String("http", "", "http proxy listen address, empty to disable")
+	id := flag.Uint("i", 0, "id")
+	user := flag.String("u", "", "user name")
+	password := flag.String("p", "", "user password")
+	waitTimeout := flag.Duration("wait", defaultWaitTimeout, "max time a connection waits for session when reconnecting")
+	udpTimeout := flag.Duration("udp-timeout", cmd.DefaultUDPTimeout, "udp associate idle timeout")
+	dnsAddr := flag.String("dns", "", "dns listen address (udp and tcp), queries are resolved by client, empty to disable")
+	routeFile := flag.String("route", "", "route file, route requests to different ids by rules")
+	authFile := flag.String("auth-file", "", "local proxy users file, one \"user password [id]\" per line")
+	users := credentials{}
+	flag.Var(users, "auth", "local proxy user user:password[:id], can be repeated")
+	var forwards forwardFlags
+	flag.Var(&forwards, "L", "static forward [bind_address:]port:host:hostport, can be repeated")
+	var logOptions cmd.LogOptions
+	logOptions.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+	logger, closer, err := logOptions.NewLogger(config.Debug)
+	if err != nil {
+		println(err.Error())
+		return
+	}
+	if closer != nil {
+		defer closer.Close()
+		// Fatal直接退出不执行defer，退出前也关闭日志文件
+		logrus.RegisterExitHandler(func() { closer.Close() })
+	}
+	config.UnsafeLogKeys = config.UnsafeLogKeys || logOptions.UnsafeKeys
+	logger.Infof("server addr: %s, sni: %s, endpoints: %d, id: %d", config.ServerAddr, config.SNI, len(config.Endpoints), byte(*id))
+	pool := newSessionPool(func(id byte) *serverSession {
+		c := *config
+		c.OverlayData = cmd.NewShortID(false, id)
+		c.Logger = logger.WithField("id", id)
+		s := newServerSession(&c, c.Logger, *user, *password)
+		s.waitTimeout = *waitTimeout
+		go s.connectForever()
+		return s
+	})
+	if *authFile != "" {
+		if err := users.load(*authFile); err != nil {
+			logger.Fatalf("auth: %v", err)
+		}
+	}
+	for _, cred := range users {
+		if cred.id >= 0 {
+			pool.pin(byte(cred.id))
+		}
+	}
+	for _, a := range exposedListens(*addr, *httpAddr, *dnsAddr, forwards, len(users) > 0) {
+		logger.Warnf("listen %s without auth, anyone can access the internal network", a)
+	}
+	p := &proxy{pool: pool, users: users, logger: logger, udpTimeout: *udpTimeout}
+	if *routeFile != "" {
+		r, err := newRouter(*routeFile, byte(*id), logger, pool)
+		if err != nil {
+			logger.Fatalf("route: %v", err)
+		}
+		go r.watch()
+		p.router = r
+	} else {
+		p.s = pool.get(byte(*id))
+	}
+	for _, f := range forwards {
+		go p.serveForward(f)
+	}
+	if *dnsAddr != "" {
+		go p.serveDNS(*dnsAddr)
+	}
+	if *httpAddr != "" {
+		go p.serve(*httpAddr, p.handleHTTPUser)
+	}
+	if *addr != "" {
+		go p.serve(*addr, p.handleUser)
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	logger.Infof("received %s, exit", <-sig)
+}
+
+// exposedListens 返回非本机可访问且不需要认证的监听，端口转发和DNS没有认证
+func exposedListens(addr, httpAddr, dnsAddr string, forwards forwardFlags, auth bool) []string {
+	var listens []string
+	if !auth {
+		listens = append(listens, addr, httpAddr)
+	}
+	listens = append(listens, dnsAddr)
+	for _, f := range forwards {
+		listens = append(listens, f.listen)
+	}
+	var exposed []string
+	for _, a := range listens {
+		if !isLoopback(a) {
+			exposed = append(exposed, a)
+		}
+	}
+	return exposed
+}
+
+// isLoopback 监听地址为空或仅本机可访问
+func isLoopback(addr string) bool {
+	if addr == "" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// serve 监听本地代理端口
+func (p *proxy) serve(addr string, handle func(net.Conn)) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		p.logger.Panic(err)
+	}
+	p.logger.Infof("listen %s", addr)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			p.logger.Errorf("accept: %v", err)
+			continue
+		}
+		go handle(conn)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/howmp/reality"
+)
+
+// newPipeSession 返回用户端会话，对端接受流后立即关闭
+func newPipeSession(t *testing.T) *yamux.Session {
+	t.Helper()
+	userConn, clientConn := net.Pipe()
+	userSession, err := yamux.Server(userConn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSession, err := yamux.Client(clientConn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		userSession.Close()
+		clientSession.Close()
+	})
+	go func() {
+		for {
+			stream, err := clientSession.Accept()
+			if err != nil {
+				return
+			}
+			stream.Close()
+		}
+	}()
+	return userSession
+}
+
+func newTestServerSession(waitTimeout time.Duration) *serverSession {
+	s := newServerSession(&reality.ClientConfig{}, reality.GetLogger(false), "", "")
+	s.waitTimeout = waitTimeout
+	return s
+}
+
+func TestSessionWait(t *testing.T) {
+	s := newTestServerSession(time.Second)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.setSession(newPipeSession(t))
+	}()
+	stream, err := s.openSessionStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+}
+
+func TestSessionWaitTimeout(t *testing.T) {
+	s := newTestServerSession(50 * time.Millisecond)
+	if _, err := s.openSessionStream(); !errors.Is(err, errSessionTimeout) {
+		t.Fatalf("got %v", err)
+	}
+
+	// 会话已关闭时清除并等待新会话
+	session := newPipeSession(t)
+	s.setSession(session)
+	session.Close()
+	if _, err := s.openSessionStream(); !errors.Is(err, errSessionTimeout) {
+		t.Fatalf("got %v", err)
+	}
+	s.setSession(newPipeSession(t))
+	stream, err := s.openSessionStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+}
+
+func TestSessionReconnect(t *testing.T) {
+	s := newTestServerSession(2 * time.Second)
+	sessions := make([]*yamux.Session, 10)
+	for i := range sessions {
+		sessions[i] = newPipeSession(t)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, session := range sessions {
+			s.setSession(session)
+			time.Sleep(10 * time.Millisecond)
+			session.Close()
+			s.clearSession(session)
+			time.Sleep(5 * time.Millisecond)
+		}
+		s.setSession(newPipeSession(t))
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				stream, err := s.openSessionStream()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				stream.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	<-done
+}
+
+// TestSessionGoAway 服务端通知即将关闭后，新流等待新会话，旧会话不关闭
+func TestSessionGoAway(t *testing.T) {
+	s := newTestServerSession(time.Second)
+	userConn, clientConn := net.Pipe()
+	userSession, err := yamux.Server(userConn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSession, err := yamux.Client(clientConn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		userSession.Close()
+		clientSession.Close()
+	})
+	goaway := s.setSession(userSession)
+	clientSession.GoAway()
+	time.Sleep(50 * time.Millisecond)
+	go func() {
+		<-goaway
+		s.setSession(newPipeSession(t))
+	}()
+	stream, err := s.openSessionStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+	if userSession.IsClosed() {
+		t.Fatal("old session should be kept for existing streams")
+	}
+}
+
+// TestSessionStop 停止后不再重连，等待中的连接立即返回
+func TestSessionStop(t *testing.T) {
+	s := newTestServerSession(time.Minute)
+	done := make(chan struct{})
+	go func() {
+		s.connectForever()
+		close(done)
+	}()
+	opened := make(chan error, 1)
+	go func() {
+		_, err := s.openSessionStream()
+		opened <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	s.stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("connectForever should return after stop")
+	}
+	if err := <-opened; !errors.Is(err, errSessionStopped) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestExposedListens(t *testing.T) {
+	var forwards forwardFlags
+	for _, f := range []string{"8080:10.0.0.1:80", "0.0.0.0:8081:10.0.0.1:80"} {
+		if err := forwards.Set(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exposed := exposedListens("0.0.0.0:61080", "", ":53", forwards, true)
+	if len(exposed) != 2 || exposed[0] != ":53" || exposed[1] != "0.0.0.0:8081" {
+		t.Fatalf("exposed %v", exposed)
+	}
+	exposed = exposedListens("0.0.0.0:61080", "127.0.0.1:8080", "", nil, false)
+	if len(exposed) != 1 || exposed[0] != "0.0.0.0:61080" {
+		t.Fatalf("exposed %v", exposed)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/sirupsen/logrus"
+)
+
+const routeReloadInterval = 5 * time.Second
+
+// route 路由规则，格式为"cidr|domain|user 值 id|direct"
+type route struct {
+	kind   string
+	value  string
+	ipNet  *net.IPNet
+	id     byte
+	direct bool
+}
+
+func (r *route) String() string {
+	action := "direct"
+	if !r.direct {
+		action = strconv.Itoa(int(r.id))
+	}
+	if r.kind == "default" {
+		return "default " + action
+	}
+	return r.kind + " " + r.value + " " + action
+}
+
+// match addr为nil时只匹配用户规则；域名不在本地解析，只匹配domain规则
+func (r *route) match(user string, addr *socks5.AddrSpec) bool {
+	switch r.kind {
+	case "user":
+		return user == r.value
+	case "cidr":
+		return addr != nil && addr.FQDN == "" && addr.IP != nil && r.ipNet.Contains(addr.IP)
+	case "domain":
+		if addr == nil || addr.FQDN == "" {
+			return false
+		}
+		fqdn := strings.ToLower(strings.TrimSuffix(addr.FQDN, "."))
+		return fqdn == r.value || strings.HasSuffix(fqdn, "."+r.value)
+	}
+	return false
+}
+
+// routeTable 按顺序匹配，都不匹配时使用默认路由
+type routeTable struct {
+	routes []*route
+	def    *route
+}
+
+func (t *routeTable) match(user string, addr *socks5.AddrSpec) *route {
+	for _, r := range t.routes {
+		if r.match(user, addr) {
+			return r
+		}
+	}
+	return t.def
+}
+
+// parseRoutes 解析路由文件，每行一条规则，#开头为注释
+func parseRoutes(reader io.Reader, defaultID byte) (*routeTable, error) {
+	t := &routeTable{def: &route{kind: "default", id: defaultID}}
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		r, err := parseRoute(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if r.kind == "default" {
+			t.def = r
+			continue
+		}
+		t.routes = append(t.routes, r)
+	}
+	return t, scanner.Err()
+}
+
+func parseRoute(text string) (*route, error) {
+	fields := strings.Fields(text)
+	r := &route{kind: fields[0]}
+	if r.kind == "default" {
+		fields = append([]string{r.kind, ""}, fields[1:]...)
+	}
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("invalid route %q", text)
+	}
+	r.value = fields[1]
+	switch r.kind {
+	case "default", "user":
+	case "cidr":
+		_, ipNet, err := net.ParseCIDR(r.value)
+		if err != nil {
+			return nil, err
+		}
+		r.ipNet = ipNet
+	case "domain":
+		r.value = strings.ToLower(strings.Trim(r.value, "."))
+	default:
+		return nil, fmt.Errorf("invalid route type %q", r.kind)
+	}
+	if fields[2] == "direct" {
+		r.direct = true
+		return r, nil
+	}
+	id, err := strconv.ParseUint(fields[2], 10, 8)
+	if err != nil || id >= 128 {
+		return nil, fmt.Errorf("invalid route id %q", fields[2])
+	}
+	r.id = byte(id)
+	return r, nil
+}
+
+// router 按路由文件选择客户端，文件修改后自动重新加载
+type router struct {
+	file      string
+	defaultID byte
+	logger    logrus.FieldLogger
+	pool      *sessionPool
+
+	lock    sync.RWMutex
+	table   *routeTable
+	modTime time.Time
+}
+
+func newRouter(file string, defaultID byte, logger logrus.FieldLogger, pool *sessionPool) (*router, error) {
+	r := &router{
+		file:      file,
+		defaultID: defaultID,
+		logger:    logger,
+		pool:      pool,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load 文件未修改时不重新加载，出错时保留原有路由
+func (r *router) load() error {
+	info, err := os.Stat(r.file)
+	if err != nil {
+		return err
+	}
+	r.lock.RLock()
+	modTime := r.modTime
+	r.lock.RUnlock()
+	if info.ModTime().Equal(modTime) {
+		return nil
+	}
+	f, err := os.Open(r.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	table, err := parseRoutes(f, r.defaultID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", r.file, err)
+	}
+	r.lock.Lock()
+	r.table = table
+	r.modTime = info.ModTime()
+	r.lock.Unlock()
+	// 提前连接路由中用到的客户端，停止不再使用的
+	ids := make(map[byte]bool)
+	for _, rt := range append(table.routes, table.def) {
+		if !rt.direct {
+			ids[rt.id] = true
+			r.pool.get(rt.id)
+		}
+	}
+	r.pool.retain(ids)
+	r.logger.Infof("load %d routes from %s, %s", len(table.routes), r.file, table.def)
+	return nil
+}
+
+func (r *router) watch() {
+	for range time.Tick(routeReloadInterval) {
+		if err := r.load(); err != nil {
+			r.logger.Errorf("reload routes: %v", err)
+		}
+	}
+}
+
+// route 返回目标对应的连接，直连时返回nil
+func (r *router) route(user string, addr *socks5.AddrSpec) *serverSession {
+	r.lock.RLock()
+	rt := r.table.match(user, addr)
+	r.lock.RUnlock()
+	if addr != nil {
+		r.logger.Debugf("route user(%s) %s -> %s", user, addr.Address(), rt)
+	}
+	if rt.direct {
+		return nil
+	}
+	return r.pool.get(rt.id)
+}
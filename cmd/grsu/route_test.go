@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/howmp/reality"
+	"github.com/howmp/reality/cmd"
+)
+
+const testRoutes = `
+# 注释
+user site3 3
+cidr 10.3.0.0/16 3
+domain site2.corp 2
+domain example.com direct
+default 1
+`
+
+func TestParseRoutes(t *testing.T) {
+	table, err := parseRoutes(strings.NewReader(testRoutes), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		user string
+		addr *socks5.AddrSpec
+		want string
+	}{
+		{"site3", &socks5.AddrSpec{FQDN: "www.qq.com", Port: 80}, "user site3 3"},
+		{"", &socks5.AddrSpec{IP: net.ParseIP("10.3.1.1"), Port: 80}, "cidr 10.3.0.0/16 3"},
+		{"", &socks5.AddrSpec{FQDN: "git.site2.corp", Port: 80}, "domain site2.corp 2"},
+		{"", &socks5.AddrSpec{FQDN: "Site2.Corp.", Port: 80}, "domain site2.corp 2"},
+		{"", &socks5.AddrSpec{FQDN: "notsite2.corp", Port: 80}, "default 1"},
+		{"", &socks5.AddrSpec{FQDN: "example.com", Port: 443}, "domain example.com direct"},
+		{"", nil, "default 1"},
+	}
+	for _, c := range cases {
+		if got := table.match(c.user, c.addr).String(); got != c.want {
+			t.Fatalf("%s %v: got %s, want %s", c.user, c.addr, got, c.want)
+		}
+	}
+	for _, text := range []string{"cidr 10.0.0.0 1", "domain a.com 128", "host a.com 1", "user a"} {
+		if _, err := parseRoutes(strings.NewReader(text), 0); err == nil {
+			t.Fatalf("%s should be invalid", text)
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "routes.txt")
+	if err := os.WriteFile(file, []byte("user site3 3\ncidr 127.0.0.0/8 direct\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var created []byte
+	pool := newSessionPool(func(id byte) *serverSession {
+		created = append(created, id)
+		return startClient(t)
+	})
+	r, err := newRouter(file, 0, reality.GetLogger(false), pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(created) != string([]byte{3, 0}) {
+		t.Fatalf("sessions %v", created)
+	}
+	if r.route("site3", nil) != pool.sessions[3] || r.route("", nil) != pool.sessions[0] {
+		t.Fatal("wrong session")
+	}
+	site3 := pool.sessions[3]
+	pool.pin(5)
+	pool.get(5)
+
+	// 直连规则在本地连接目标
+	targetAddr := startEcho(t)
+	addr := startProxy(t, &proxy{router: r, logger: reality.GetLogger(false)})
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req := cmd.AppendAddr([]byte{5, 1, 2, 1, 1, 'a', 1, 'b', 5, 1, 0}, &socks5.AddrSpec{IP: targetAddr.IP, Port: targetAddr.Port})
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 2+2+3)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != socks5.UserPassAuth || reply[3] != 0 || reply[5] != cmd.SocksReplySuccess {
+		t.Fatalf("reply %v", reply)
+	}
+	if _, err := cmd.ReadAddr(conn); err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, conn)
+
+	// 修改文件后重新加载
+	time.Sleep(10 * time.Millisecond)
+	if err := os.WriteFile(file, []byte("default direct\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(file, time.Now(), time.Now().Add(time.Second))
+	if err := r.load(); err != nil {
+		t.Fatal(err)
+	}
+	if r.route("site3", nil) != nil {
+		t.Fatal("should be direct after reload")
+	}
+	// 不再使用的连接停止重连，pin的保留
+	if len(pool.sessions) != 1 || pool.sessions[5] == nil {
+		t.Fatalf("sessions %v", pool.sessions)
+	}
+	if _, err := site3.openSessionStream(); !errors.Is(err, errSessionStopped) {
+		t.Fatalf("removed session: %v", err)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/howmp/reality/cmd"
+	"github.com/sirupsen/logrus"
+)
+
+// proxy 本地socks5服务，CONNECT交给客户端处理，UDP ASSOCIATE在本地处理后通过数据报流转发
+type proxy struct {
+	s          *serverSession
+	router     *router
+	pool       *sessionPool
+	users      credentials
+	localDNS   *cmd.DNSForwarder
+	logger     logrus.FieldLogger
+	udpTimeout time.Duration
+}
+
+// route 选择目标对应的连接，用户指定了id时优先使用，未配置路由时使用默认连接，直连时返回nil
+func (p *proxy) route(user string, addr *socks5.AddrSpec) *serverSession {
+	if cred := p.users[user]; cred != nil && cred.id >= 0 {
+		return p.pool.get(byte(cred.id))
+	}
+	if p.router == nil {
+		return p.s
+	}
+	return p.router.route(user, addr)
+}
+
+// handleUser 根据首字节区分socks5和HTTP代理请求
+func (p *proxy) handleUser(c net.Conn) {
+	defer c.Close()
+	conn := newBufferedConn(c)
+	first, err := conn.r.Peek(1)
+	if err != nil {
+		return
+	}
+	if first[0] != cmd.SocksVersion {
+		p.handleHTTP(conn)
+		return
+	}
+	command, addr, user, err := negotiate(conn, p.users)
+	if err != nil {
+		p.logger.Errorf("socks5 %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	switch command {
+	case cmd.SocksCommandConnect:
+		p.handleConnect(conn, user, addr)
+	case cmd.SocksCommandAssociate:
+		p.handleAssociate(conn, user)
+	default:
+		cmd.WriteSocksReply(conn, cmd.SocksReplyCommandNotSupported, nil)
+		p.logger.Errorf("socks5 %s: unsupported command %d", conn.RemoteAddr(), command)
+	}
+}
+
+// negotiate 完成socks5协商，返回请求命令、目标地址和用户名
+//
+// users不为空时要求用户名密码认证，否则用户提供的用户名只用于路由，不做校验
+func negotiate(conn net.Conn, users credentials) (byte, *socks5.AddrSpec, string, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return 0, nil, "", err
+	}
+	if hdr[0] != cmd.SocksVersion {
+		return 0, nil, "", fmt.Errorf("unsupported version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return 0, nil, "", err
+	}
+	var user string
+	switch {
+	case bytes.IndexByte(methods, socks5.UserPassAuth) != -1:
+		if _, err := conn.Write([]byte{cmd.SocksVersion, socks5.UserPassAuth}); err != nil {
+			return 0, nil, "", err
+		}
+		var password string
+		var err error
+		if user, password, err = readUserPass(conn); err != nil {
+			return 0, nil, "", err
+		}
+		if len(users) != 0 && users.check(user, password) == nil {
+			conn.Write([]byte{userPassVersion, 1})
+			return 0, nil, "", fmt.Errorf("user(%s) auth failed", user)
+		}
+		if _, err := conn.Write([]byte{userPassVersion, 0}); err != nil {
+			return 0, nil, "", err
+		}
+	case len(users) == 0 && bytes.IndexByte(methods, socks5.NoAuth) != -1:
+		if _, err := conn.Write([]byte{cmd.SocksVersion, socks5.NoAuth}); err != nil {
+			return 0, nil, "", err
+		}
+	default:
+		conn.Write([]byte{cmd.SocksVersion, 0xff})
+		return 0, nil, "", errors.New("no acceptable auth method")
+	}
+	hdr = make([]byte, 3)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return 0, nil, "", err
+	}
+	if hdr[0] != cmd.SocksVersion {
+		return 0, nil, "", fmt.Errorf("unsupported version %d", hdr[0])
+	}
+	addr, err := cmd.ReadAddr(conn)
+	if err != nil {
+		return 0, nil, "", err
+	}
+	return hdr[1], addr, user, nil
+}
+
+// userPassVersion RFC1929用户名密码认证版本
+const userPassVersion = 1
+
+// readUserPass 读取RFC1929认证请求 VER ULEN UNAME PLEN PASSWD
+func readUserPass(r io.Reader) (string, string, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return "", "", err
+	}
+	if hdr[0] != userPassVersion {
+		return "", "", fmt.Errorf("unsupported auth version %d", hdr[0])
+	}
+	user := make([]byte, hdr[1]+1)
+	if _, err := io.ReadFull(r, user); err != nil {
+		return "", "", err
+	}
+	password := make([]byte, user[hdr[1]])
+	if _, err := io.ReadFull(r, password); err != nil {
+		return "", "", err
+	}
+	return string(user[:hdr[1]]), string(password), nil
+}
+
+// handleConnect 通过客户端连接目标，客户端的回复转发给用户
+func (p *proxy) handleConnect(conn net.Conn, user string, addr *socks5.AddrSpec) {
+	stream, reply, bind, err := p.dialConnect(user, addr)
+	if err != nil {
+		cmd.WriteSocksReply(conn, reply, nil)
+		p.logger.Errorf("connect %s: %v", addr, err)
+		return
+	}
+	defer stream.Close()
+	if err := cmd.WriteSocksReply(conn, reply, bind); err != nil {
+		return
+	}
+	p.logger.Infof("socks5 user(%s) %s connect %s", user, conn.RemoteAddr(), addr.Address())
+	go io.Copy(stream, conn)
+	io.Copy(conn, stream)
+}
+
+// dialConnect 向客户端重新发起socks5 CONNECT请求，路由为直连时在本地连接，失败时返回应答给用户的回复码
+func (p *proxy) dialConnect(user string, addr *socks5.AddrSpec) (net.Conn, byte, *socks5.AddrSpec, error) {
+	s := p.route(user, addr)
+	if s == nil {
+		return dialDirect(addr)
+	}
+	stream, err := s.openStream(cmd.StreamSocks)
+	if err != nil {
+		return nil, cmd.SocksReplyServerFailure, nil, fmt.Errorf("open session stream: %w", err)
+	}
+	req := []byte{cmd.SocksVersion, 1, 0, cmd.SocksVersion, cmd.SocksCommandConnect, 0}
+	if _, err := stream.Write(cmd.AppendAddr(req, addr)); err != nil {
+		stream.Close()
+		return nil, cmd.SocksReplyServerFailure, nil, err
+	}
+	// 方法选择(2) + VER REP RSV(3) + BND.ADDR
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(stream, hdr); err != nil {
+		stream.Close()
+		return nil, cmd.SocksReplyServerFailure, nil, err
+	}
+	bind, err := cmd.ReadAddr(stream)
+	if err != nil {
+		stream.Close()
+		return nil, cmd.SocksReplyServerFailure, nil, err
+	}
+	if hdr[3] != cmd.SocksReplySuccess {
+		stream.Close()
+		return nil, hdr[3], nil, fmt.Errorf("socks5 reply %d", hdr[3])
+	}
+	return stream, cmd.SocksReplySuccess, bind, nil
+}
+
+const dialTimeout = 10 * time.Second
+
+func dialDirect(addr *socks5.AddrSpec) (net.Conn, byte, *socks5.AddrSpec, error) {
+	conn, err := net.DialTimeout("tcp", addr.Address(), dialTimeout)
+	if err != nil {
+		return nil, cmd.SocksReplyHostUnreachable, nil, err
+	}
+	local := conn.LocalAddr().(*net.TCPAddr)
+	return conn, cmd.SocksReplySuccess, &socks5.AddrSpec{IP: local.IP, Port: local.Port}, nil
+}
+
+// bufferedConn 预读首字节后仍可完整读取的连接
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newBufferedConn(conn net.Conn) *bufferedConn {
+	return &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// handleAssociate 在本地监听UDP端口，用户的数据报通过数据报流交给客户端中继
+//
+// 数据报的目标各不相同，只按用户名路由，不支持直连
+func (p *proxy) handleAssociate(conn net.Conn, user string) {
+	s := p.route(user, nil)
+	if s == nil {
+		cmd.WriteSocksReply(conn, cmd.SocksReplyCommandNotSupported, nil)
+		p.logger.Errorf("udp associate: direct route not supported")
+		return
+	}
+	var ip net.IP
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		cmd.WriteSocksReply(conn, cmd.SocksReplyServerFailure, nil)
+		p.logger.Errorf("udp associate: %v", err)
+		return
+	}
+	defer udpConn.Close()
+	stream, err := s.openStream(cmd.StreamUDP)
+	if err != nil {
+		cmd.WriteSocksReply(conn, cmd.SocksReplyServerFailure, nil)
+		p.logger.Errorf("open session stream: %v", err)
+		return
+	}
+	defer stream.Close()
+	bind := udpConn.LocalAddr().(*net.UDPAddr)
+	if err := cmd.WriteSocksReply(conn, cmd.SocksReplySuccess, &socks5.AddrSpec{IP: bind.IP, Port: bind.Port}); err != nil {
+		return
+	}
+	p.logger.Infof("udp associate %s for user(%s) %s", bind, user, conn.RemoteAddr())
+	relayUDP(conn, udpConn, stream, p.udpTimeout)
+	p.logger.Infof("udp associate %s closed", bind)
+}
+
+// relayUDP 中继一个UDP关联，控制连接关闭或空闲超时后结束
+func relayUDP(ctrl net.Conn, udpConn *net.UDPConn, stream net.Conn, timeout time.Duration) {
+	closeAll := func() {
+		ctrl.Close()
+		udpConn.Close()
+		stream.Close()
+	}
+	idle := cmd.WatchIdle(timeout, closeAll)
+	defer idle.Stop()
+	defer closeAll()
+	go func() {
+		io.Copy(io.Discard, ctrl)
+		closeAll()
+	}()
+
+	// 只接受来自控制连接同一IP的数据报，回复发往最近一次的用户地址
+	var clientIP net.IP
+	if addr, ok := ctrl.RemoteAddr().(*net.TCPAddr); ok {
+		clientIP = addr.IP
+	}
+	var clientAddr atomic.Pointer[net.UDPAddr]
+	go func() {
+		defer closeAll()
+		for {
+			addr, data, err := cmd.ReadDatagram(stream)
+			if err != nil {
+				return
+			}
+			idle.Touch()
+			to := clientAddr.Load()
+			if to == nil {
+				continue
+			}
+			packet := cmd.AppendAddr([]byte{0, 0, 0}, addr)
+			if _, err := udpConn.WriteToUDP(append(packet, data...), to); err != nil {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 0xFFFF)
+	for {
+		n, from, err := udpConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if clientIP != nil && !clientIP.Equal(from.IP) {
+			continue
+		}
+		// RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT DATA，不支持分片
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		reader := bytes.NewReader(buf[3:n])
+		addr, err := cmd.ReadAddr(reader)
+		if err != nil {
+			continue
+		}
+		idle.Touch()
+		clientAddr.Store(from)
+		if err := cmd.WriteDatagram(stream, addr, buf[n-reader.Len():n]); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/hashicorp/yamux"
+	"github.com/howmp/reality"
+	"github.com/howmp/reality/cmd"
+)
+
+// startClient 模拟grss和grsc，返回已连接的serverSession
+func startClient(t *testing.T) *serverSession {
+	t.Helper()
+	logger := reality.GetLogger(false)
+	userConn, clientConn := net.Pipe()
+	userSession, err := yamux.Server(userConn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSession, err := yamux.Client(clientConn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		userSession.Close()
+		clientSession.Close()
+	})
+	socksServer, err := socks5.New(&socks5.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			stream, err := clientSession.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer stream.Close()
+				streamType, err := cmd.ReadStreamType(stream)
+				if err != nil {
+					return
+				}
+				switch streamType {
+				case cmd.StreamSocks:
+					socksServer.ServeConn(stream)
+				case cmd.StreamUDP:
+					cmd.ServeUDP(stream, socks5.DNSResolver{}, cmd.NewRuleSet(nil, nil), time.Second, nil, logger)
+				case cmd.StreamDNS:
+					cmd.NewDNSForwarder(&cmd.Resolver{}).ServeStream(stream, logger)
+				case cmd.StreamForward:
+					addr, err := cmd.ReadAddr(stream)
+					if err != nil {
+						return
+					}
+					target, err := net.Dial("tcp", addr.Address())
+					if err != nil {
+						stream.Write([]byte{cmd.SocksReplyHostUnreachable})
+						return
+					}
+					defer target.Close()
+					stream.Write([]byte{cmd.SocksReplySuccess})
+					go io.Copy(target, stream)
+					io.Copy(stream, target)
+				}
+			}()
+		}
+	}()
+	s := newServerSession(&reality.ClientConfig{}, logger, "", "")
+	s.setSession(userSession)
+	return s
+}
+
+func startProxy(t *testing.T, p *proxy) net.Addr {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.handleUser(conn)
+		}
+	}()
+	return l.Addr()
+}
+
+// socksRequest 发送socks5请求，返回回复中的绑定地址
+func socksRequest(t *testing.T, conn net.Conn, command byte, addr *socks5.AddrSpec) *socks5.AddrSpec {
+	t.Helper()
+	req := cmd.AppendAddr([]byte{5, 1, 0, 5, command, 0}, addr)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != cmd.SocksReplySuccess {
+		t.Fatalf("socks5 reply %d", reply[1])
+	}
+	bind, err := cmd.ReadAddr(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bind
+}
+
+// startEcho 启动TCP回显服务
+func startEcho(t *testing.T) *net.TCPAddr {
+	t.Helper()
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { target.Close() })
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return target.Addr().(*net.TCPAddr)
+}
+
+func checkEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("got %q", buf)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	targetAddr := startEcho(t)
+
+	addr := startProxy(t, &proxy{s: startClient(t), logger: reality.GetLogger(false)})
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	socksRequest(t, conn, cmd.SocksCommandConnect, &socks5.AddrSpec{IP: targetAddr.IP, Port: targetAddr.Port})
+	checkEcho(t, conn)
+}
+
+func TestForwardFlags(t *testing.T) {
+	cases := []struct {
+		value, listen, target string
+	}{
+		{"3389:10.0.0.5:3389", "127.0.0.1:3389", "10.0.0.5:3389"},
+		{"0.0.0.0:13306:db.corp:3306", "0.0.0.0:13306", "db.corp:3306"},
+		{"[::1]:8080:[fd00::1]:80", "[::1]:8080", "[fd00::1]:80"},
+	}
+	for _, c := range cases {
+		var f forwardFlags
+		if err := f.Set(c.value); err != nil {
+			t.Fatal(err)
+		}
+		if f[0].listen != c.listen || f[0].target.Address() != c.target {
+			t.Fatalf("%s: got %s -> %s", c.value, f[0].listen, f[0].target.Address())
+		}
+	}
+	var f forwardFlags
+	if err := f.Set("10.0.0.5:3389"); err == nil {
+		t.Fatal("should be invalid")
+	}
+}
+
+func TestForward(t *testing.T) {
+	targetAddr := startEcho(t)
+	p := &proxy{s: startClient(t), logger: reality.GetLogger(false)}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		p.handleForward(conn, &socks5.AddrSpec{IP: targetAddr.IP, Port: targetAddr.Port})
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	checkEcho(t, conn)
+}
+
+func TestUDPAssociate(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	addr := startProxy(t, &proxy{s: startClient(t), logger: reality.GetLogger(false), udpTimeout: time.Second})
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	bind := socksRequest(t, conn, cmd.SocksCommandAssociate, &socks5.AddrSpec{IP: net.IPv4zero})
+
+	udpConn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: bind.IP, Port: bind.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	header := cmd.AppendAddr([]byte{0, 0, 0}, &socks5.AddrSpec{IP: echoAddr.IP, Port: echoAddr.Port})
+	for i := 0; i < 3; i++ {
+		payload := []byte{'p', 'i', 'n', 'g', byte('0' + i)}
+		if _, err := udpConn.Write(append(header, payload...)); err != nil {
+			t.Fatal(err)
+		}
+		udpConn.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 2048)
+		n, err := udpConn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(buf[:n], header) || !bytes.Equal(buf[len(header):n], payload) {
+			t.Fatalf("got %x, want %x%x", buf[:n], header, payload)
+		}
+	}
+
+	// 空闲超时后控制连接应被关闭
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("control connection should be closed after idle timeout, got %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/mattn/go-colorable"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+
+	defaultLogMaxSizeMB  = 100
+	defaultLogMaxBackups = 5
+)
+
+// LogOptions 命令行日志参数，grss使用go-flags标签，grsc、grsu使用RegisterFlags
+type LogOptions struct {
+	Level      string `long:"log-level" description:"log level (trace, debug, info, warn, error), default info or debug if config debug is set"`
+	Format     string `long:"log-format" default:"text" choice:"text" choice:"json" description:"log format"`
+	File       string `long:"log-file" description:"log file, rotated by size, default stderr"`
+	MaxSizeMB  int    `long:"log-max-size" default:"100" description:"log file max size in MB"`
+	MaxBackups int    `long:"log-max-backups" default:"5" description:"rotated log files to keep"`
+	UnsafeKeys bool   `long:"log-unsafe-keys" description:"log session keys and nonces at debug level, only for troubleshooting"`
+}
+
+func (o *LogOptions) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Level, "log-level", "", "log level (trace, debug, info, warn, error), default info or debug if config debug is set")
+	fs.StringVar(&o.Format, "log-format", LogFormatText, "log format, text or json")
+	fs.StringVar(&o.File, "log-file", "", "log file, rotated by size, default stderr")
+	fs.IntVar(&o.MaxSizeMB, "log-max-size", defaultLogMaxSizeMB, "log file max size in MB")
+	fs.IntVar(&o.MaxBackups, "log-max-backups", defaultLogMaxBackups, "rotated log files to keep")
+	fs.BoolVar(&o.UnsafeKeys, "log-unsafe-keys", false, "log session keys and nonces at debug level, only for troubleshooting")
+}
+
+// ParseLevel 未指定级别时由配置中的debug决定
+func (o *LogOptions) ParseLevel(debug bool) (logrus.Level, error) {
+	if o.Level != "" {
+		return logrus.ParseLevel(o.Level)
+	}
+	if debug {
+		return logrus.DebugLevel, nil
+	}
+	return logrus.InfoLevel, nil
+}
+
+// NewLogger 按参数创建带时间戳的日志，写入文件时返回的io.Closer用于关闭文件，否则为nil
+func (o *LogOptions) NewLogger(debug bool) (*logrus.Logger, io.Closer, error) {
+	level, err := o.ParseLevel(debug)
+	if err != nil {
+		return nil, nil, err
+	}
+	logger := logrus.New()
+	logger.SetLevel(level)
+	switch o.Format {
+	case "", LogFormatText:
+		logger.Formatter = &logrus.TextFormatter{
+			ForceColors:   o.File == "",
+			DisableColors: o.File != "",
+			FullTimestamp: true,
+		}
+	case LogFormatJSON:
+		logger.Formatter = &logrus.JSONFormatter{}
+	default:
+		return nil, nil, fmt.Errorf("unknown log format %q", o.Format)
+	}
+	if o.File == "" {
+		logger.SetOutput(colorable.NewColorableStderr())
+		return logger, nil, nil
+	}
+	maxSize, maxBackups := o.MaxSizeMB, o.MaxBackups
+	if maxSize <= 0 {
+		maxSize = defaultLogMaxSizeMB
+	}
+	w, err := NewRotatingWriter(o.File, int64(maxSize)<<20, maxBackups)
+	if err != nil {
+		return nil, nil, err
+	}
+	logger.SetOutput(w)
+	return logger, w, nil
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestLogOptionsLevel(t *testing.T) {
+	o := &LogOptions{}
+	if level, _ := o.ParseLevel(false); level != logrus.InfoLevel {
+		t.Fatalf("default level %s", level)
+	}
+	if level, _ := o.ParseLevel(true); level != logrus.DebugLevel {
+		t.Fatalf("debug level %s", level)
+	}
+	o.Level = "warn"
+	if level, _ := o.ParseLevel(true); level != logrus.WarnLevel {
+		t.Fatalf("explicit level %s", level)
+	}
+	o.Level = "loud"
+	if _, _, err := o.NewLogger(false); err == nil {
+		t.Fatal("invalid level accepted")
+	}
+	o.Level, o.Format = "", "xml"
+	if _, _, err := o.NewLogger(false); err == nil {
+		t.Fatal("invalid format accepted")
+	}
+}
+
+func TestLogOptionsJSONFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "grss.log")
+	o := &LogOptions{Format: LogFormatJSON, File: file, MaxSizeMB: 1}
+	logger, closer, err := o.NewLogger(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Debug("hidden")
+	logger.WithField("id", 3).Info("hello")
+	closer.Close()
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("want 1 line, got %q", data)
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["msg"] != "hello" || record["level"] != "info" || record["id"] != float64(3) || record["time"] == nil {
+		t.Fatalf("record %v", record)
+	}
+}
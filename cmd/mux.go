@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/howmp/reality"
+)
+
+// YamuxConfig 将配置转换为yamux配置，为空的字段使用yamux默认值
+func YamuxConfig(c *reality.MuxConfig) *yamux.Config {
+	config := yamux.DefaultConfig()
+	if c == nil {
+		return config
+	}
+	if c.WindowSize != 0 {
+		config.MaxStreamWindowSize = c.WindowSize
+	}
+	if c.KeepAliveSecond != 0 {
+		config.KeepAliveInterval = time.Duration(c.KeepAliveSecond) * time.Second
+	}
+	if c.WriteTimeoutSecond != 0 {
+		config.ConnectionWriteTimeout = time.Duration(c.WriteTimeoutSecond) * time.Second
+	}
+	return config
+}
+
+// Mux 多路复用会话，yamux会话和每个流使用独立连接的ConnMux、DialMux都实现该接口
+type Mux interface {
+	// Open 打开新流
+	Open() (net.Conn, error)
+	// Accept 接收对端打开的流
+	Accept() (net.Conn, error)
+	Close() error
+	IsClosed() bool
+	// CloseChan 会话关闭后该通道被关闭
+	CloseChan() <-chan struct{}
+	NumStreams() int
+	RemoteAddr() net.Addr
+}
+
+var _ Mux = (*yamux.Session)(nil)
+
+// NewMuxSession 按配置创建yamux会话，client为true时作为yamux客户端
+func NewMuxSession(conn net.Conn, c *reality.MuxConfig, client bool) (Mux, error) {
+	config := YamuxConfig(c)
+	var session *yamux.Session
+	var err error
+	if client {
+		session, err = yamux.Client(conn, config)
+	} else {
+		session, err = yamux.Server(conn, config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// GoAway 通知对端不再接收新流，已有的流不受影响，none模式的会话不支持，返回nil
+func GoAway(m Mux) error {
+	if g, ok := m.(interface{ GoAway() error }); ok {
+		return g.GoAway()
+	}
+	return nil
+}
+
+// IsGoAway 打开流失败是因为对端已通知不再接收新流
+func IsGoAway(err error) bool {
+	return errors.Is(err, yamux.ErrRemoteGoAway)
+}
+
+// CloseWhenIdle 会话上没有流时关闭，用于切换到新会话后让旧会话上的流继续完成
+func CloseWhenIdle(m Mux, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for m.NumStreams() > 0 {
+		select {
+		case <-m.CloseChan():
+			return
+		case <-ticker.C:
+		}
+	}
+	m.Close()
+}
+
+// StreamLimiter 限制一个会话同时处理的流数量
+type StreamLimiter struct {
+	max    int64
+	active int64
+}
+
+// NewStreamLimiter max为0时不限制
+func NewStreamLimiter(c *reality.MuxConfig) *StreamLimiter {
+	l := &StreamLimiter{}
+	if c != nil {
+		l.max = int64(c.MaxStreams)
+	}
+	return l
+}
+
+// Acquire 超过上限时返回false，成功时需要调用Release
+func (l *StreamLimiter) Acquire() bool {
+	if atomic.AddInt64(&l.active, 1) > l.max && l.max > 0 {
+		atomic.AddInt64(&l.active, -1)
+		return false
+	}
+	return true
+}
+
+func (l *StreamLimiter) Release() {
+	atomic.AddInt64(&l.active, -1)
+}
@@ -0,0 +1,159 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/howmp/reality"
+)
+
+func TestYamuxConfig(t *testing.T) {
+	config := YamuxConfig(nil)
+	if config.MaxStreamWindowSize != yamux.DefaultConfig().MaxStreamWindowSize {
+		t.Fatal("nil config should use defaults")
+	}
+	config = YamuxConfig(&reality.MuxConfig{WindowSize: 4 << 20, KeepAliveSecond: 5, WriteTimeoutSecond: 3})
+	if config.MaxStreamWindowSize != 4<<20 || config.KeepAliveInterval != 5*time.Second || config.ConnectionWriteTimeout != 3*time.Second {
+		t.Fatalf("config not applied: %+v", config)
+	}
+	if err := yamux.VerifyConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&reality.MuxConfig{WindowSize: 1024}).Validate(); err == nil {
+		t.Fatal("small window should be invalid")
+	}
+}
+
+func TestStreamLimiter(t *testing.T) {
+	l := NewStreamLimiter(&reality.MuxConfig{MaxStreams: 2})
+	if !l.Acquire() || !l.Acquire() || l.Acquire() {
+		t.Fatal("should allow 2 streams")
+	}
+	l.Release()
+	if !l.Acquire() {
+		t.Fatal("should allow after release")
+	}
+	l = NewStreamLimiter(nil)
+	for i := 0; i < 100; i++ {
+		if !l.Acquire() {
+			t.Fatal("should not limit")
+		}
+	}
+}
+
+// tcpPair 返回一对已连接的TCP连接
+func tcpPair(tb testing.TB) (net.Conn, net.Conn) {
+	tb.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// delayRelay 转发数据，每块数据延迟delay后写出，模拟单向延迟
+func delayRelay(dst io.Writer, src io.Reader, delay time.Duration) {
+	type chunk struct {
+		data []byte
+		at   time.Time
+	}
+	chunks := make(chan chunk, 4096)
+	go func() {
+		defer close(chunks)
+		for {
+			buf := make([]byte, 32*1024)
+			n, err := src.Read(buf)
+			if n > 0 {
+				chunks <- chunk{buf[:n], time.Now().Add(delay)}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	for c := range chunks {
+		time.Sleep(time.Until(c.at))
+		if _, err := dst.Write(c.data); err != nil {
+			return
+		}
+	}
+}
+
+// latencyPair 返回一对连接，双向各有delay延迟
+func latencyPair(tb testing.TB, delay time.Duration) (net.Conn, net.Conn) {
+	a, relayA := tcpPair(tb)
+	relayB, b := tcpPair(tb)
+	go delayRelay(relayB, relayA, delay)
+	go delayRelay(relayA, relayB, delay)
+	return a, b
+}
+
+// BenchmarkMuxLatency 模拟40ms往返延迟，比较不同窗口大小下单个流的吞吐
+//
+//	go test -bench MuxLatency ./cmd
+func BenchmarkMuxLatency(b *testing.B) {
+	const size = 4 << 20
+	for _, window := range []uint32{256 << 10, 1 << 20, 4 << 20} {
+		b.Run(fmt.Sprintf("window-%dk", window>>10), func(b *testing.B) {
+			config := &reality.MuxConfig{WindowSize: window}
+			clientConn, serverConn := latencyPair(b, 20*time.Millisecond)
+			client, err := NewMuxSession(clientConn, config, true)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer client.Close()
+			server, err := NewMuxSession(serverConn, config, false)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer server.Close()
+			go func() {
+				for {
+					stream, err := server.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						defer stream.Close()
+						if _, err := io.CopyN(io.Discard, stream, size); err == nil {
+							stream.Write([]byte{0})
+						}
+					}()
+				}
+			}()
+			data := make([]byte, size)
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				stream, err := client.Open()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := stream.Write(data); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.ReadFull(stream, make([]byte, 1)); err != nil {
+					b.Fatal(err)
+				}
+				stream.Close()
+			}
+		})
+	}
+}
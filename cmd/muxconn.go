@@ -0,0 +1,511 @@
+package cmd
+
+import (
+	"bufio"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/howmp/reality"
+)
+
+// none模式下客户端连接建立后发送的握手类型
+const (
+	HelloSession byte = 0 // 会话主连接，连接断开表示会话结束
+	HelloIdle    byte = 1 // 空闲连接，服务端打开流时使用
+	HelloStream  byte = 2 // 客户端打开的流
+)
+
+const (
+	idleQueueSize     = 64               // 服务端每个会话缓存的空闲连接数上限
+	idleOpenTimeout   = 10 * time.Second // 服务端等待空闲连接的超时时间
+	idleRetryInterval = time.Second      // 客户端建立空闲连接失败后的重试间隔
+	heartbeatMisses   = 3                // 超过该数量的心跳间隔未收到数据时认为连接失效
+)
+
+// 心跳: 双方每隔心跳间隔在主连接上发送heartbeat；服务端在空闲连接上发送idlePing，客户端回复idlePong，
+// 超过半个心跳间隔未确认存活的空闲连接在使用前先确认，因此服务端打开的流写入的第一个字节不能是idlePing(流类型不会是该值)
+const (
+	heartbeat byte = 0
+	idlePing  byte = 0xFF
+	idlePong  byte = 0xFE
+)
+
+var (
+	ErrMuxClosed = errors.New("mux closed")
+	errNoIdle    = errors.New("no idle connection")
+)
+
+// SessionID none模式下标识同一会话的多个连接
+type SessionID [8]byte
+
+func NewSessionID() (SessionID, error) {
+	var id SessionID
+	_, err := rand.Read(id[:])
+	return id, err
+}
+
+// WriteHello 发送握手: 类型(1) 会话ID(8)
+func WriteHello(w io.Writer, kind byte, id SessionID) error {
+	_, err := w.Write(append([]byte{kind}, id[:]...))
+	return err
+}
+
+func ReadHello(r io.Reader) (byte, SessionID, error) {
+	var id SessionID
+	buf := make([]byte, 1+len(id))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, id, err
+	}
+	copy(id[:], buf[1:])
+	return buf[0], id, nil
+}
+
+// connSet 记录会话的连接，会话关闭时一并关闭
+type connSet struct {
+	lock         sync.Mutex
+	conns        map[net.Conn]struct{}
+	streams      int
+	closed       chan struct{}
+	once         sync.Once
+	keepAlive    time.Duration // 心跳间隔
+	writeTimeout time.Duration // 每次写入的超时
+}
+
+func (s *connSet) init(keepAlive, writeTimeout time.Duration) {
+	s.conns = make(map[net.Conn]struct{})
+	s.closed = make(chan struct{})
+	s.keepAlive, s.writeTimeout = keepAlive, writeTimeout
+}
+
+// connMuxTimeouts 心跳间隔和写超时，与yamux模式使用相同的配置和默认值
+func connMuxTimeouts(c *reality.MuxConfig) (time.Duration, time.Duration) {
+	config := YamuxConfig(c)
+	return config.KeepAliveInterval, config.ConnectionWriteTimeout
+}
+
+// add 会话已关闭时返回false
+func (s *connSet) add(conn net.Conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	select {
+	case <-s.closed:
+		return false
+	default:
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *connSet) remove(conn net.Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.conns, conn)
+}
+
+// stream 将连接作为流返回，流关闭时更新计数
+func (s *connSet) stream(conn net.Conn) net.Conn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.streams++
+	return &connStream{Conn: conn, set: s}
+}
+
+func (s *connSet) close() {
+	s.once.Do(func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		close(s.closed)
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.conns = nil
+	})
+}
+
+func (s *connSet) IsClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *connSet) CloseChan() <-chan struct{} {
+	return s.closed
+}
+
+func (s *connSet) NumStreams() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.streams
+}
+
+// watch 主连接断开或超过heartbeatMisses个心跳间隔未收到对端心跳时关闭会话
+func (s *connSet) watch(conn net.Conn) {
+	defer s.close()
+	go s.heartbeat(conn)
+	buf := make([]byte, 64)
+	for {
+		conn.SetReadDeadline(time.Now().Add(s.keepAlive * heartbeatMisses))
+		if _, err := conn.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
+// heartbeat 定期在主连接上发送心跳，写入失败时关闭会话
+func (s *connSet) heartbeat(conn net.Conn) {
+	ticker := time.NewTicker(s.keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+			if _, err := conn.Write([]byte{heartbeat}); err != nil {
+				s.close()
+				return
+			}
+		}
+	}
+}
+
+// connStream 每次写入使用写超时，调用者设置的写截止时间更早时使用调用者的
+type connStream struct {
+	net.Conn
+	set  *connSet
+	once sync.Once
+
+	deadlineLock  sync.Mutex
+	writeDeadline time.Time
+}
+
+func (c *connStream) Write(b []byte) (int, error) {
+	deadline := time.Now().Add(c.set.writeTimeout)
+	c.deadlineLock.Lock()
+	if !c.writeDeadline.IsZero() && c.writeDeadline.Before(deadline) {
+		deadline = c.writeDeadline
+	}
+	c.deadlineLock.Unlock()
+	c.Conn.SetWriteDeadline(deadline)
+	return c.Conn.Write(b)
+}
+
+func (c *connStream) SetDeadline(t time.Time) error {
+	c.setWriteDeadline(t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *connStream) SetWriteDeadline(t time.Time) error {
+	c.setWriteDeadline(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *connStream) setWriteDeadline(t time.Time) {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.writeDeadline = t
+}
+
+func (c *connStream) Close() error {
+	c.once.Do(func() {
+		c.set.lock.Lock()
+		c.set.streams--
+		delete(c.set.conns, c.Conn)
+		c.set.lock.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// ConnMux none模式服务端会话，由主连接和客户端建立的空闲连接、流连接组成
+type ConnMux struct {
+	connSet
+	conn      net.Conn
+	idle      chan *idleConn
+	idleCount int // 未被使用的空闲连接数，受lock保护
+	accepted  chan net.Conn
+}
+
+// idleConn 服务端的空闲连接，alive为最后一次确认存活的时间
+type idleConn struct {
+	net.Conn
+	alive time.Time
+}
+
+var _ Mux = (*ConnMux)(nil)
+
+// NewConnMux conn为已读取HelloSession的主连接，c为nil时使用默认的心跳间隔和写超时
+func NewConnMux(conn net.Conn, c *reality.MuxConfig) *ConnMux {
+	keepAlive, writeTimeout := connMuxTimeouts(c)
+	return newConnMux(conn, keepAlive, writeTimeout)
+}
+
+func newConnMux(conn net.Conn, keepAlive, writeTimeout time.Duration) *ConnMux {
+	m := &ConnMux{
+		conn:     conn,
+		idle:     make(chan *idleConn),
+		accepted: make(chan net.Conn),
+	}
+	m.init(keepAlive, writeTimeout)
+	m.add(conn)
+	go m.watch(conn)
+	return m
+}
+
+// AddConn 加入客户端建立的连接，kind为HelloIdle或HelloStream，失败时由调用者关闭连接
+func (m *ConnMux) AddConn(kind byte, conn net.Conn) error {
+	if !m.add(conn) {
+		return ErrMuxClosed
+	}
+	switch kind {
+	case HelloIdle:
+		m.lock.Lock()
+		full := m.idleCount >= idleQueueSize
+		if !full {
+			m.idleCount++
+		}
+		m.lock.Unlock()
+		if full {
+			m.remove(conn)
+			return errors.New("too many idle connections")
+		}
+		go m.keepIdle(&idleConn{Conn: conn, alive: time.Now()})
+		return nil
+	case HelloStream:
+		select {
+		case m.accepted <- conn:
+			return nil
+		case <-m.closed:
+			return ErrMuxClosed
+		}
+	}
+	m.remove(conn)
+	return errors.New("unknown hello type")
+}
+
+// keepIdle 定期确认空闲连接存活，失效时关闭，被Open取走或会话关闭后返回
+func (m *ConnMux) keepIdle(conn *idleConn) {
+	defer func() {
+		m.lock.Lock()
+		m.idleCount--
+		m.lock.Unlock()
+	}()
+	ticker := time.NewTicker(m.keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case m.idle <- conn:
+			return
+		case <-ticker.C:
+			if err := m.ping(conn); err != nil {
+				m.remove(conn.Conn)
+				conn.Close()
+				return
+			}
+		case <-m.closed:
+			return
+		}
+	}
+}
+
+// ping 在空闲连接上发送心跳并等待客户端回复
+func (m *ConnMux) ping(conn *idleConn) error {
+	defer conn.SetDeadline(time.Time{})
+	conn.SetDeadline(time.Now().Add(m.writeTimeout))
+	if _, err := conn.Write([]byte{idlePing}); err != nil {
+		return err
+	}
+	pong := make([]byte, 1)
+	if _, err := io.ReadFull(conn, pong); err != nil {
+		return err
+	}
+	if pong[0] != idlePong {
+		return errors.New("unexpected idle pong")
+	}
+	conn.alive = time.Now()
+	return nil
+}
+
+// Open 使用一个空闲连接作为流，较久未确认存活的先发送心跳，失效时丢弃并使用下一个，
+// 客户端收到数据后会补充空闲连接
+func (m *ConnMux) Open() (net.Conn, error) {
+	timer := time.NewTimer(idleOpenTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case conn := <-m.idle:
+			if time.Since(conn.alive) > m.keepAlive/2 {
+				if err := m.ping(conn); err != nil {
+					m.remove(conn.Conn)
+					conn.Close()
+					continue
+				}
+			}
+			return m.stream(conn.Conn), nil
+		case <-m.closed:
+			return nil, ErrMuxClosed
+		case <-timer.C:
+			return nil, errNoIdle
+		}
+	}
+}
+
+func (m *ConnMux) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.accepted:
+		return m.stream(conn), nil
+	case <-m.closed:
+		return nil, ErrMuxClosed
+	}
+}
+
+func (m *ConnMux) Close() error {
+	m.close()
+	return nil
+}
+
+func (m *ConnMux) RemoteAddr() net.Addr {
+	return m.conn.RemoteAddr()
+}
+
+// DialMux none模式客户端会话，每次打开流时调用dial建立新连接
+type DialMux struct {
+	connSet
+	conn     net.Conn
+	dial     func(kind byte) (net.Conn, error)
+	accepted chan net.Conn
+}
+
+var _ Mux = (*DialMux)(nil)
+
+// NewDialMux conn为已发送HelloSession的主连接，为nil时会话只在Close后关闭；
+// dial建立连接并发送对应类型的握手；idle为保持的空闲连接数，为0时不接收流；
+// c为nil时使用默认的心跳间隔和写超时
+func NewDialMux(conn net.Conn, dial func(kind byte) (net.Conn, error), idle int, c *reality.MuxConfig) *DialMux {
+	keepAlive, writeTimeout := connMuxTimeouts(c)
+	return newDialMux(conn, dial, idle, keepAlive, writeTimeout)
+}
+
+func newDialMux(conn net.Conn, dial func(kind byte) (net.Conn, error), idle int, keepAlive, writeTimeout time.Duration) *DialMux {
+	m := &DialMux{
+		conn:     conn,
+		dial:     dial,
+		accepted: make(chan net.Conn),
+	}
+	m.init(keepAlive, writeTimeout)
+	if conn != nil {
+		m.add(conn)
+		go m.watch(conn)
+	}
+	for i := 0; i < idle; i++ {
+		go m.keepIdle()
+	}
+	return m
+}
+
+// keepIdle 保持一个空闲连接，服务端使用或连接失效后建立新的
+func (m *DialMux) keepIdle() {
+	for !m.IsClosed() {
+		conn, err := m.dial(HelloIdle)
+		if err == nil {
+			if !m.add(conn) {
+				conn.Close()
+				return
+			}
+			r := bufio.NewReader(conn)
+			err = m.waitStream(conn, r)
+			m.remove(conn)
+			if err == nil {
+				peeked := &peekedConn{Conn: conn, r: r}
+				if !m.add(peeked) {
+					conn.Close()
+					return
+				}
+				select {
+				case m.accepted <- peeked:
+					continue
+				case <-m.closed:
+					return
+				}
+			}
+			conn.Close()
+		}
+		select {
+		case <-m.closed:
+			return
+		case <-time.After(idleRetryInterval):
+		}
+	}
+}
+
+// waitStream 等待服务端使用空闲连接，期间回复服务端的心跳，
+// 超过heartbeatMisses个心跳间隔未收到数据时认为连接失效
+func (m *DialMux) waitStream(conn net.Conn, r *bufio.Reader) error {
+	for {
+		conn.SetReadDeadline(time.Now().Add(m.keepAlive * heartbeatMisses))
+		b, err := r.Peek(1)
+		if err != nil {
+			return err
+		}
+		if b[0] != idlePing {
+			return conn.SetReadDeadline(time.Time{})
+		}
+		r.Discard(1)
+		conn.SetWriteDeadline(time.Now().Add(m.writeTimeout))
+		if _, err := conn.Write([]byte{idlePong}); err != nil {
+			return err
+		}
+	}
+}
+
+func (m *DialMux) Open() (net.Conn, error) {
+	if m.IsClosed() {
+		return nil, ErrMuxClosed
+	}
+	conn, err := m.dial(HelloStream)
+	if err != nil {
+		return nil, err
+	}
+	if !m.add(conn) {
+		conn.Close()
+		return nil, ErrMuxClosed
+	}
+	return m.stream(conn), nil
+}
+
+func (m *DialMux) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.accepted:
+		return m.stream(conn), nil
+	case <-m.closed:
+		return nil, ErrMuxClosed
+	}
+}
+
+func (m *DialMux) Close() error {
+	m.close()
+	return nil
+}
+
+func (m *DialMux) RemoteAddr() net.Addr {
+	if m.conn == nil {
+		return nil
+	}
+	return m.conn.RemoteAddr()
+}
+
+// peekedConn 读取时先返回已预读的数据
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
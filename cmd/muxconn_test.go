@@ -0,0 +1,273 @@
+package cmd
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/howmp/reality"
+)
+
+// connMuxPair 通过net.Pipe建立none模式的服务端和客户端会话
+func connMuxPair(t *testing.T, idle int) (*ConnMux, *DialMux) {
+	t.Helper()
+	sid, err := NewSessionID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, clientConn := net.Pipe()
+	server := NewConnMux(serverConn, nil)
+	dial := func(kind byte) (net.Conn, error) {
+		s, c := net.Pipe()
+		go func() {
+			k, id, err := ReadHello(s)
+			if err != nil || id != sid || server.AddConn(k, s) != nil {
+				s.Close()
+			}
+		}()
+		if err := WriteHello(c, kind, sid); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+	client := NewDialMux(clientConn, dial, idle, nil)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return server, client
+}
+
+// echoStream 在from上写入数据，从to读出
+func echoStream(t *testing.T, from, to net.Conn, msg string) {
+	t.Helper()
+	go from.Write([]byte(msg))
+	buf := make([]byte, len(msg))
+	to.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(to, buf); err != nil || string(buf) != msg {
+		t.Fatalf("read %q: %v", buf, err)
+	}
+}
+
+func TestConnMuxClientOpen(t *testing.T) {
+	server, client := connMuxPair(t, 0)
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoStream(t, stream, accepted, "hello")
+	echoStream(t, accepted, stream, "world")
+	if server.NumStreams() != 1 || client.NumStreams() != 1 {
+		t.Fatalf("streams %d %d", server.NumStreams(), client.NumStreams())
+	}
+	stream.Close()
+	accepted.Close()
+	if server.NumStreams() != 0 || client.NumStreams() != 0 {
+		t.Fatalf("streams %d %d after close", server.NumStreams(), client.NumStreams())
+	}
+}
+
+// TestConnMuxServerOpen 服务端打开的流数量超过空闲连接数时，客户端应补充空闲连接
+func TestConnMuxServerOpen(t *testing.T) {
+	server, client := connMuxPair(t, 2)
+	for i := 0; i < 5; i++ {
+		stream, err := server.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go stream.Write([]byte{StreamSocks})
+		accepted, err := client.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if streamType, err := ReadStreamType(accepted); err != nil || streamType != StreamSocks {
+			t.Fatalf("stream type %d: %v", streamType, err)
+		}
+		echoStream(t, accepted, stream, "pong")
+	}
+}
+
+// TestConnMuxClose 主连接关闭后两端会话和流都应关闭
+func TestConnMuxClose(t *testing.T) {
+	server, client := connMuxPair(t, 1)
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	select {
+	case <-server.CloseChan():
+	case <-time.After(time.Second):
+		t.Fatal("server should be closed")
+	}
+	if _, err := stream.Write([]byte{0}); err == nil {
+		t.Fatal("stream should be closed")
+	}
+	if _, err := server.Open(); err != ErrMuxClosed {
+		t.Fatalf("open after close: %v", err)
+	}
+	if _, err := client.Open(); err != ErrMuxClosed {
+		t.Fatalf("open after close: %v", err)
+	}
+}
+
+func TestMuxConfigMode(t *testing.T) {
+	var c *reality.MuxConfig
+	if !c.Multiplexed() || c.IdleConnCount() != reality.DefaultMuxIdleConns {
+		t.Fatal("nil config should use yamux")
+	}
+	c = &reality.MuxConfig{Mode: reality.MuxModeNone, IdleConns: 8}
+	if c.Multiplexed() || c.IdleConnCount() != 8 {
+		t.Fatal("none mode not applied")
+	}
+	if err := (&reality.MuxConfig{Mode: "smux"}).Validate(); err == nil {
+		t.Fatal("unknown mode should be invalid")
+	}
+}
+
+// pongIdle 模拟客户端的空闲连接，回复服务端的心跳
+func pongIdle(conn net.Conn) {
+	buf := make([]byte, 1)
+	for {
+		if _, err := conn.Read(buf); err != nil || buf[0] != idlePing {
+			return
+		}
+		if _, err := conn.Write([]byte{idlePong}); err != nil {
+			return
+		}
+	}
+}
+
+// newTestConnMux 主连接对端持续发送心跳的服务端会话
+func newTestConnMux(t *testing.T, keepAlive, writeTimeout time.Duration) *ConnMux {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	m := newConnMux(serverConn, keepAlive, writeTimeout)
+	go io.Copy(io.Discard, clientConn)
+	go func() {
+		for !m.IsClosed() {
+			clientConn.Write([]byte{heartbeat})
+			time.Sleep(keepAlive / 2)
+		}
+	}()
+	t.Cleanup(func() {
+		m.Close()
+		clientConn.Close()
+	})
+	return m
+}
+
+func idleCount(m *ConnMux) int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.idleCount
+}
+
+// TestConnMuxStaleIdle 不回复心跳的空闲连接被丢弃，不会由Open返回
+func TestConnMuxStaleIdle(t *testing.T) {
+	m := newTestConnMux(t, 50*time.Millisecond, 50*time.Millisecond)
+	dead, deadPeer := net.Pipe()
+	defer deadPeer.Close()
+	if err := m.AddConn(HelloIdle, dead); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for idleCount(m) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("stale idle conn should be dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 较久未确认的空闲连接在Open时确认，失效的跳过
+	m = newTestConnMux(t, time.Second, 50*time.Millisecond)
+	dead, deadPeer = net.Pipe()
+	defer deadPeer.Close()
+	alive, alivePeer := net.Pipe()
+	defer alivePeer.Close()
+	go pongIdle(alivePeer)
+	for _, conn := range []net.Conn{dead, alive} {
+		if err := m.AddConn(HelloIdle, conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(600 * time.Millisecond)
+	stream, err := m.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.(*connStream).Conn != alive {
+		t.Fatal("open should skip the dead idle conn")
+	}
+}
+
+// TestDialMuxIdleRedial 空闲连接超过心跳间隔未收到服务端心跳时重新建立
+func TestDialMuxIdleRedial(t *testing.T) {
+	dials := make(chan struct{}, 16)
+	dial := func(kind byte) (net.Conn, error) {
+		s, c := net.Pipe()
+		go io.Copy(io.Discard, s)
+		dials <- struct{}{}
+		return c, nil
+	}
+	m := newDialMux(nil, dial, 1, 50*time.Millisecond, 50*time.Millisecond)
+	defer m.Close()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-dials:
+		case <-time.After(idleRetryInterval + time.Second):
+			t.Fatal("idle conn should be redialed")
+		}
+	}
+}
+
+// TestConnMuxHeartbeat 主连接上没有心跳时关闭会话，双方都发送心跳时保持
+func TestConnMuxHeartbeat(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go io.Copy(io.Discard, clientConn)
+	m := newConnMux(serverConn, 50*time.Millisecond, 50*time.Millisecond)
+	select {
+	case <-m.CloseChan():
+	case <-time.After(time.Second):
+		t.Fatal("session without heartbeat should be closed")
+	}
+
+	serverConn, clientConn = net.Pipe()
+	server := newConnMux(serverConn, 50*time.Millisecond, 50*time.Millisecond)
+	client := newDialMux(clientConn, nil, 0, 50*time.Millisecond, 50*time.Millisecond)
+	defer server.Close()
+	defer client.Close()
+	time.Sleep(300 * time.Millisecond)
+	if server.IsClosed() || client.IsClosed() {
+		t.Fatal("session with heartbeat should be kept")
+	}
+}
+
+// TestConnStreamWriteTimeout 对端不读取时写入超时，调用者设置的截止时间更早时使用调用者的
+func TestConnStreamWriteTimeout(t *testing.T) {
+	m := newTestConnMux(t, time.Second, 50*time.Millisecond)
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	m.add(conn)
+	stream := m.stream(conn)
+	start := time.Now()
+	if _, err := stream.Write([]byte("x")); err == nil {
+		t.Fatal("write should time out")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("write timeout after %s", elapsed)
+	}
+	m.writeTimeout = time.Minute
+	stream.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	start = time.Now()
+	if _, err := stream.Write([]byte("x")); err == nil || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("write deadline not applied: %v", err)
+	}
+}
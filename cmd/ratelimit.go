@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Limiter 令牌桶限速器，rate为每秒字节数，桶容量为1秒的流量，0表示不限速
+type Limiter struct {
+	lock   sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+
+	bytes     int64         // 经过的字节数
+	throttled time.Duration // 因限速等待的总时间
+}
+
+func NewLimiter(rate int64) *Limiter {
+	return &Limiter{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+// SetRate 运行时修改速率
+func (l *Limiter) SetRate(rate int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if rate != l.rate {
+		l.rate = rate
+		l.tokens = float64(rate)
+		l.last = time.Now()
+	}
+}
+
+func (l *Limiter) Rate() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.rate
+}
+
+// Stats 返回经过的总字节数和因限速等待的总时间
+func (l *Limiter) Stats() (int64, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.bytes, l.throttled
+}
+
+// WaitN 消耗n个令牌，令牌不足时等待，允许透支，由后续调用者等待补齐
+func (l *Limiter) WaitN(n int) {
+	l.lock.Lock()
+	l.bytes += int64(n)
+	if l.rate <= 0 {
+		l.lock.Unlock()
+		return
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+		l.throttled += wait
+	}
+	l.lock.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+type limitedConn struct {
+	net.Conn
+	readLimiters  []*Limiter
+	writeLimiters []*Limiter
+}
+
+// LimitConn 包装连接，读写时依次经过对应的限速器
+func LimitConn(conn net.Conn, readLimiters, writeLimiters []*Limiter) net.Conn {
+	return &limitedConn{Conn: conn, readLimiters: readLimiters, writeLimiters: writeLimiters}
+}
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	for _, l := range c.readLimiters {
+		l.WaitN(n)
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(b []byte) (int, error) {
+	for _, l := range c.writeLimiters {
+		l.WaitN(len(b))
+	}
+	return c.Conn.Write(b)
+}
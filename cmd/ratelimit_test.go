@@ -0,0 +1,31 @@
+package cmd_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/howmp/reality/cmd"
+)
+
+func TestLimiter(t *testing.T) {
+	l := cmd.NewLimiter(100 * 1024)
+	start := time.Now()
+	// 桶内初始有1秒的令牌，再消耗1秒的量应等待约1秒
+	for i := 0; i < 20; i++ {
+		l.WaitN(10 * 1024)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond || elapsed > 1500*time.Millisecond {
+		t.Fatalf("elapsed %s, want about 1s", elapsed)
+	}
+
+	l.SetRate(0)
+	start = time.Now()
+	l.WaitN(1 << 30)
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Fatalf("unlimited limiter should not wait, elapsed %s", elapsed)
+	}
+	bytes, throttled := l.Stats()
+	if bytes != 200*1024+1<<30 || throttled < 900*time.Millisecond {
+		t.Fatalf("stats %d %s", bytes, throttled)
+	}
+}
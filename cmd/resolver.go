@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/armon/go-socks5"
+)
+
+// Resolver 实现socks5.NameResolver，可运行时指定DNS服务器和按域名后缀的上游，未指定时使用系统解析
+type Resolver struct {
+	lock      sync.RWMutex
+	server    string
+	upstreams map[string]string
+}
+
+var _ socks5.NameResolver = (*Resolver)(nil)
+
+// SetServer 设置DNS服务器地址(host:port)，为空则使用系统解析
+func (r *Resolver) SetServer(server string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.server = server
+}
+
+func (r *Resolver) Server() string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.server
+}
+
+// SetUpstreams 设置按域名后缀使用的DNS服务器，后缀最长的优先
+func (r *Resolver) SetUpstreams(upstreams map[string]string) {
+	normalized := make(map[string]string, len(upstreams))
+	for suffix, server := range upstreams {
+		normalized[strings.ToLower(strings.Trim(suffix, "."))] = server
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.upstreams = normalized
+}
+
+// ServerFor 返回解析name使用的DNS服务器，为空表示使用系统解析
+func (r *Resolver) ServerFor(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	server, matched := r.server, ""
+	for suffix, upstream := range r.upstreams {
+		if (name == suffix || strings.HasSuffix(name, "."+suffix)) && len(suffix) > len(matched) {
+			server, matched = upstream, suffix
+		}
+	}
+	return server
+}
+
+// resolverFor 返回解析name使用的net.Resolver
+func (r *Resolver) resolverFor(name string) *net.Resolver {
+	server := r.ServerFor(name)
+	if server == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+func (r *Resolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	addrs, err := r.resolverFor(name).LookupIPAddr(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	// 与net.ResolveIPAddr一致，优先使用IPv4
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			return ctx, addr.IP, nil
+		}
+	}
+	return ctx, addrs[0].IP, nil
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingWriter 写入文件，超过MaxSize字节时将文件重命名为path.1，原有的path.1改为path.2，依此类推，最多保留MaxBackups个
+type RotatingWriter struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+func NewRotatingWriter(path string, maxSize int64, maxBackups int) (*RotatingWriter, error) {
+	w := &RotatingWriter{Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *RotatingWriter) open() error {
+	f, err := os.OpenFile(w.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file, w.size = f, info.Size()
+	return nil
+}
+
+// Write 一次写入的内容不会被拆分到两个文件
+func (w *RotatingWriter) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+	if w.MaxSize > 0 && w.size > 0 && w.size+int64(len(b)) > w.MaxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *RotatingWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+	if w.MaxBackups <= 0 {
+		os.Remove(w.Path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", w.Path, w.MaxBackups))
+		for i := w.MaxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", w.Path, i), fmt.Sprintf("%s.%d", w.Path, i+1))
+		}
+		if err := os.Rename(w.Path, w.Path+".1"); err != nil {
+			return err
+		}
+	}
+	return w.open()
+}
+
+func (w *RotatingWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	w, err := NewRotatingWriter(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	want := map[string]string{"": "dddddd\n", ".1": "cccccc\n", ".2": "bbbbbb\n"}
+	for suffix, content := range want {
+		data, err := os.ReadFile(path + suffix)
+		if err != nil || string(data) != content {
+			t.Fatalf("%s%s: %q %v", path, suffix, data, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatal("should keep 2 backups")
+	}
+
+	// 重新打开时从已有大小继续计算
+	w, err = NewRotatingWriter(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.Write([]byte("eeeeee\n"))
+	if data, _ := os.ReadFile(path + ".1"); string(data) != "dddddd\n" {
+		t.Fatalf("should rotate on reopen: %q", data)
+	}
+}
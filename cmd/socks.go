@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/armon/go-socks5"
+)
+
+// socks5协议常量
+const (
+	SocksVersion = 5
+
+	SocksCommandConnect   = 1
+	SocksCommandBind      = 2
+	SocksCommandAssociate = 3
+
+	SocksAddrIPv4 = 1
+	SocksAddrFQDN = 3
+	SocksAddrIPv6 = 4
+
+	SocksReplySuccess             = 0
+	SocksReplyServerFailure       = 1
+	SocksReplyRuleFailure         = 2
+	SocksReplyHostUnreachable     = 4
+	SocksReplyCommandNotSupported = 7
+)
+
+// ReadAddr 读取socks5格式的地址: ATYP ADDR PORT
+func ReadAddr(r io.Reader) (*socks5.AddrSpec, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return nil, err
+	}
+	addr := &socks5.AddrSpec{}
+	switch atyp[0] {
+	case SocksAddrIPv4:
+		addr.IP = make(net.IP, net.IPv4len)
+		if _, err := io.ReadFull(r, addr.IP); err != nil {
+			return nil, err
+		}
+	case SocksAddrIPv6:
+		addr.IP = make(net.IP, net.IPv6len)
+		if _, err := io.ReadFull(r, addr.IP); err != nil {
+			return nil, err
+		}
+	case SocksAddrFQDN:
+		fqdn, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		addr.FQDN = fqdn
+	default:
+		return nil, fmt.Errorf("unknown address type %d", atyp[0])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return nil, err
+	}
+	addr.Port = int(binary.BigEndian.Uint16(port))
+	return addr, nil
+}
+
+// AppendAddr 追加socks5格式的地址，FQDN优先
+func AppendAddr(b []byte, addr *socks5.AddrSpec) []byte {
+	switch {
+	case addr.FQDN != "":
+		b = append(b, SocksAddrFQDN, byte(len(addr.FQDN)))
+		b = append(b, addr.FQDN...)
+	case addr.IP.To4() != nil:
+		b = append(b, SocksAddrIPv4)
+		b = append(b, addr.IP.To4()...)
+	default:
+		b = append(b, SocksAddrIPv6)
+		b = append(b, addr.IP.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(addr.Port))
+}
+
+// ParseAddr 解析host:port为socks5地址
+func ParseAddr(hostport string) (*socks5.AddrSpec, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	p, err := net.LookupPort("tcp", port)
+	if err != nil {
+		return nil, err
+	}
+	addr := &socks5.AddrSpec{Port: p}
+	if ip := net.ParseIP(host); ip != nil {
+		addr.IP = ip
+	} else if len(host) > 255 {
+		return nil, fmt.Errorf("host too long: %s", host)
+	} else {
+		addr.FQDN = host
+	}
+	return addr, nil
+}
+
+// WriteSocksReply 发送socks5回复，bind为nil时使用0.0.0.0:0
+func WriteSocksReply(w io.Writer, reply byte, bind *socks5.AddrSpec) error {
+	if bind == nil {
+		bind = &socks5.AddrSpec{IP: net.IPv4zero}
+	}
+	_, err := w.Write(AppendAddr([]byte{SocksVersion, reply, 0}, bind))
+	return err
+}
@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/armon/go-socks5"
+)
+
+// 流类型，打开流后首先发送1字节流类型
+const (
+	StreamSocks   byte = 0 // 服务端转发用户的socks5流量给客户端
+	StreamReport  byte = 1 // 客户端向服务端上报消息
+	StreamControl byte = 2 // 服务端向客户端下发控制消息
+	StreamUDP     byte = 3 // 用户的UDP数据报，格式见WriteDatagram
+	StreamForward byte = 4 // 端口转发，流类型后为socks5格式的目标地址，对端连接目标后回复1字节socks5回复码
+	StreamDNS     byte = 5 // 用户的DNS查询，格式见WriteDNSMessage
+)
+
+// 服务端向客户端打开的Socks、UDP、Forward、DNS流，在流类型后发送8字节流ID，客户端上报审计结果时使用
+
+// 消息类型
+const (
+	MessageDeny   byte = 1 // 客户端拒绝访问目标
+	MessagePolicy byte = 2 // 服务端下发运行时策略，内容为reality.ClientPolicy
+	MessageAck    byte = 3 // 客户端确认控制消息
+	MessageAudit  byte = 4 // 客户端上报流的目标和结果
+	MessageGoaway byte = 5 // 服务端即将关闭，客户端应连接其他服务端地址，已有的流在原会话上继续完成，内容为空对象
+)
+
+// DenyMessage 客户端按规则拒绝访问目标时上报
+type DenyMessage struct {
+	Dest string `json:"dest"`
+	Rule string `json:"rule"`
+}
+
+// AuditMessage 流结束后客户端上报的目标和结果，上行为从流读取的字节数
+type AuditMessage struct {
+	ID         uint64    `json:"id"`
+	Type       byte      `json:"type"`
+	Dest       string    `json:"dest,omitempty"`
+	Resolved   string    `json:"resolved,omitempty"`
+	Result     string    `json:"result"`
+	Upload     int64     `json:"upload"`
+	Download   int64     `json:"download"`
+	Start      time.Time `json:"start"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+// AckMessage 客户端确认控制消息，Error为空表示成功
+type AckMessage struct {
+	Error string `json:"error,omitempty"`
+}
+
+const maxMessageSize = 0xFFFF
+
+func WriteStreamType(w io.Writer, streamType byte) error {
+	_, err := w.Write([]byte{streamType})
+	return err
+}
+
+func ReadStreamType(r io.Reader) (byte, error) {
+	streamType := make([]byte, 1)
+	if _, err := io.ReadFull(r, streamType); err != nil {
+		return 0, err
+	}
+	return streamType[0], nil
+}
+
+func WriteStreamID(w io.Writer, id uint64) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, id)
+	_, err := w.Write(buf)
+	return err
+}
+
+func ReadStreamID(r io.Reader) (uint64, error) {
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf), nil
+}
+
+// WriteMessage 发送消息，格式: 消息类型(1) 长度(2) JSON数据
+func WriteMessage(w io.Writer, messageType byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(data) > maxMessageSize {
+		return errors.New("message too large")
+	}
+	buf := make([]byte, 3+len(data))
+	buf[0] = messageType
+	buf[1] = byte(len(data) >> 8)
+	buf[2] = byte(len(data))
+	copy(buf[3:], data)
+	_, err = w.Write(buf)
+	return err
+}
+
+// ReadMessage 读取消息，返回消息类型和JSON数据
+func ReadMessage(r io.Reader) (byte, []byte, error) {
+	hdr := make([]byte, 3)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, nil, err
+	}
+	data := make([]byte, int(hdr[1])<<8|int(hdr[2]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], data, nil
+}
+
+// WriteForward 发送端口转发的目标地址
+func WriteForward(w io.Writer, addr *socks5.AddrSpec) error {
+	_, err := w.Write(AppendAddr(nil, addr))
+	return err
+}
+
+// ReadForwardReply 读取对端连接目标的结果
+func ReadForwardReply(r io.Reader) error {
+	reply := make([]byte, 1)
+	if _, err := io.ReadFull(r, reply); err != nil {
+		return err
+	}
+	if reply[0] != SocksReplySuccess {
+		return fmt.Errorf("forward failed, reply %d", reply[0])
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultUDPTimeout UDP关联的默认空闲超时时间
+const DefaultUDPTimeout = 60 * time.Second
+
+const maxDatagramSize = 0xFFFF
+
+// WriteDatagram 在流中发送一个数据报，格式: 长度(2) 地址 数据，地址为socks5格式，长度包含地址和数据
+func WriteDatagram(w io.Writer, addr *socks5.AddrSpec, data []byte) error {
+	buf := make([]byte, 2, 2+7+len(data))
+	buf = AppendAddr(buf, addr)
+	buf = append(buf, data...)
+	l := len(buf) - 2
+	if l > maxDatagramSize {
+		return errors.New("datagram too large")
+	}
+	buf[0] = byte(l >> 8)
+	buf[1] = byte(l)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadDatagram 从流中读取一个数据报
+func ReadDatagram(r io.Reader) (*socks5.AddrSpec, []byte, error) {
+	l := make([]byte, 2)
+	if _, err := io.ReadFull(r, l); err != nil {
+		return nil, nil, err
+	}
+	data := make([]byte, int(l[0])<<8|int(l[1]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, nil, err
+	}
+	reader := bytes.NewReader(data)
+	addr, err := ReadAddr(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return addr, data[len(data)-reader.Len():], nil
+}
+
+// IdleWatcher 超过timeout没有活动时调用onIdle
+type IdleWatcher struct {
+	last int64
+	done chan struct{}
+	once sync.Once
+}
+
+func WatchIdle(timeout time.Duration, onIdle func()) *IdleWatcher {
+	w := &IdleWatcher{last: time.Now().UnixNano(), done: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(timeout / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.done:
+				return
+			case now := <-ticker.C:
+				if now.Sub(time.Unix(0, atomic.LoadInt64(&w.last))) >= timeout {
+					onIdle()
+					return
+				}
+			}
+		}
+	}()
+	return w
+}
+
+// Touch 记录一次活动
+func (w *IdleWatcher) Touch() {
+	atomic.StoreInt64(&w.last, time.Now().UnixNano())
+}
+
+func (w *IdleWatcher) Stop() {
+	w.once.Do(func() { close(w.done) })
+}
+
+// ErrUDPDenied 数据报的目标被规则拒绝
+var ErrUDPDenied = errors.New("denied")
+
+// UDPAudit 每个发出的数据报调用一次，addr为目标(已解析时IP不为空)，err为解析、规则检查或发送的错误
+type UDPAudit func(addr *socks5.AddrSpec, err error)
+
+// ServeUDP 客户端侧UDP中继，从流中读取数据报发往目标，目标的回复封装后写回流，空闲超时后关闭，audit可以为nil
+func ServeUDP(stream net.Conn, resolver socks5.NameResolver, rules *RuleSet, timeout time.Duration, audit UDPAudit, logger logrus.FieldLogger) error {
+	if audit == nil {
+		audit = func(*socks5.AddrSpec, error) {}
+	}
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return err
+	}
+	defer udpConn.Close()
+	defer stream.Close()
+	idle := WatchIdle(timeout, func() {
+		logger.Debugf("udp relay %s idle timeout", udpConn.LocalAddr())
+		stream.Close()
+		udpConn.Close()
+	})
+	defer idle.Stop()
+
+	go func() {
+		defer stream.Close()
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, from, err := udpConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			idle.Touch()
+			if err := WriteDatagram(stream, &socks5.AddrSpec{IP: from.IP, Port: from.Port}, buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	resolved := make(map[string]net.IP)
+	for {
+		addr, data, err := ReadDatagram(stream)
+		if err != nil {
+			return nil
+		}
+		idle.Touch()
+		if addr.FQDN != "" {
+			ip, ok := resolved[addr.FQDN]
+			if !ok {
+				if _, ip, err = resolver.Resolve(context.Background(), addr.FQDN); err != nil {
+					logger.Warnf("udp resolve %s: %v", addr.FQDN, err)
+					audit(addr, fmt.Errorf("resolve: %w", err))
+					continue
+				}
+				resolved[addr.FQDN] = ip
+			}
+			addr.IP = ip
+		}
+		if rule, allow := rules.Check(addr.FQDN, addr.IP, addr.Port); !allow {
+			if rules.OnDeny != nil {
+				rules.OnDeny(&socks5.Request{Command: SocksCommandAssociate, DestAddr: addr}, rule)
+			}
+			audit(addr, ErrUDPDenied)
+			continue
+		}
+		if _, err := udpConn.WriteToUDP(data, &net.UDPAddr{IP: addr.IP, Port: addr.Port}); err != nil {
+			logger.Debugf("udp write %s: %v", addr, err)
+			audit(addr, fmt.Errorf("send: %w", err))
+			continue
+		}
+		audit(addr, nil)
+	}
+}
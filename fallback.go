@@ -0,0 +1,117 @@
+package reality
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// clientHelloTimeout 等待客户端发送ClientHello的时间，超时后交给默认目标处理
+const clientHelloTimeout = 10 * time.Second
+
+// maxClientHelloLen TLS record的最大长度
+const maxClientHelloLen = 16384 + 2048
+
+// validateFallbacks 检查SNI到回落目标的映射
+func validateFallbacks(fallbacks map[string]string) error {
+	for name, target := range fallbacks {
+		if name == "" || strings.Count(name, "*") > 1 || (strings.Contains(name, "*") && !strings.HasPrefix(name, "*.")) {
+			return fmt.Errorf("fallback name %q", name)
+		}
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return fmt.Errorf("fallback %s target %s: %v", name, target, err)
+		}
+	}
+	return nil
+}
+
+// fallbackTarget 按SNI选择回落目标，依次匹配完整域名和*.通配，未匹配或没有SNI时使用SNIAddr，
+// 与模拟目标的默认站点行为一致。客户端使用的SNI始终交给SNIAddr，避免通配把它转到其他网站
+func (c *ServerConfig) fallbackTarget(sni string) string {
+	name := strings.ToLower(strings.TrimSuffix(sni, "."))
+	if name == "" || len(c.Fallbacks) == 0 || name == strings.ToLower(c.sniHost) {
+		return c.SNIAddr
+	}
+	if target, ok := c.Fallbacks[name]; ok {
+		return target
+	}
+	for {
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return c.SNIAddr
+		}
+		name = name[i+1:]
+		if target, ok := c.Fallbacks["*."+name]; ok {
+			return target
+		}
+	}
+}
+
+// readClientHello 读取客户端的第一个TLS record，返回读取到的原始数据，是ClientHello时同时返回SNI，
+// 不是TLS时只读取record头，出错时返回已读取的部分
+func readClientHello(conn io.Reader) ([]byte, string, error) {
+	raw := make([]byte, recordHeaderLen)
+	if n, err := io.ReadFull(conn, raw); err != nil {
+		return raw[:n], "", err
+	}
+	recordLen := int(raw[3])<<8 | int(raw[4])
+	if raw[0] != recordTypeHandshake || recordLen > maxClientHelloLen {
+		return raw, "", nil
+	}
+	raw = append(raw, make([]byte, recordLen)...)
+	if n, err := io.ReadFull(conn, raw[recordHeaderLen:]); err != nil {
+		return raw[:recordHeaderLen+n], "", err
+	}
+	return raw, parseSNI(raw[recordHeaderLen:]), nil
+}
+
+// parseSNI 从ClientHello中解析server_name扩展，解析失败返回空
+func parseSNI(data []byte) string {
+	s := cryptobyte.String(data)
+	var msgType uint8
+	var body, sessionID, cipherSuites, compression, extensions cryptobyte.String
+	if !s.ReadUint8(&msgType) || msgType != typeClientHello ||
+		!s.ReadUint24LengthPrefixed(&body) ||
+		!body.Skip(2+32) || // version(2) random(32)
+		!body.ReadUint8LengthPrefixed(&sessionID) ||
+		!body.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!body.ReadUint8LengthPrefixed(&compression) ||
+		!body.ReadUint16LengthPrefixed(&extensions) {
+		return ""
+	}
+	for !extensions.Empty() {
+		var extType uint16
+		var extData cryptobyte.String
+		if !extensions.ReadUint16(&extType) || !extensions.ReadUint16LengthPrefixed(&extData) {
+			return ""
+		}
+		if extType != 0 { // server_name
+			continue
+		}
+		var names cryptobyte.String
+		if !extData.ReadUint16LengthPrefixed(&names) {
+			return ""
+		}
+		for !names.Empty() {
+			var nameType uint8
+			var name cryptobyte.String
+			if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+				return ""
+			}
+			if nameType == 0 { // host_name
+				return string(name)
+			}
+		}
+	}
+	return ""
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
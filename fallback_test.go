@@ -0,0 +1,152 @@
+package reality_test
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/howmp/reality"
+)
+
+// listenTarget 模拟回落目标，收到连接时发送name
+func listenTarget(t *testing.T, name string, accepted chan<- string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- name
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestFallbackBySNI(t *testing.T) {
+	accepted := make(chan string, 8)
+	_, port, _ := net.SplitHostPort(listenTarget(t, "default", accepted))
+	config, err := reality.NewServerConfig(net.JoinHostPort("localhost", port), "127.0.0.1:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Logger = reality.GetLogger(false)
+	config.Fallbacks = map[string]string{
+		"a.example.com":   listenTarget(t, "a", accepted),
+		"*.example.org":   listenTarget(t, "org", accepted),
+		"www.example.org": listenTarget(t, "www", accepted),
+		"localhost":       listenTarget(t, "localhost", accepted),
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := reality.Listen("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for sni, want := range map[string]string{
+		"a.example.com":   "a",
+		"A.Example.com.":  "a",
+		"b.example.com":   "default",
+		"www.example.org": "www",
+		"x.y.example.org": "org",
+		"example.org":     "default",
+		"":                "default",
+		"localhost":       "default",
+	} {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+		tls.Client(conn, &tls.Config{ServerName: sni, InsecureSkipVerify: true}).Handshake()
+		conn.Close()
+		select {
+		case got := <-accepted:
+			if got != want {
+				t.Errorf("sni %q fallback to %s, want %s", sni, got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("sni %q not forwarded", sni)
+		}
+	}
+}
+
+func TestFallbackValidate(t *testing.T) {
+	for _, fallbacks := range []map[string]string{
+		{"": "1.2.3.4:443"},
+		{"a.*.com": "1.2.3.4:443"},
+		{"*example.com": "1.2.3.4:443"},
+		{"a.com": "1.2.3.4"},
+	} {
+		config, err := reality.NewServerConfig("example.com:443", "1.2.3.4:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Fallbacks = fallbacks
+		if err := config.Validate(); err == nil {
+			t.Errorf("fallbacks %v accepted", fallbacks)
+		}
+	}
+}
+
+// TestFallbackPartialHello 不完整的ClientHello仍转发给默认目标，与未读取SNI时一致
+func TestFallbackPartialHello(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan []byte, 4)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			b, _ := io.ReadAll(conn)
+			conn.Write([]byte("bye"))
+			conn.Close()
+			received <- b
+		}
+	}()
+	config, err := reality.NewServerConfig(l.Addr().String(), "127.0.0.1:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Logger = reality.GetLogger(false)
+	rl, err := reality.Listen("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+	for _, sent := range []string{"", "\x16\x03", "\x16\x03\x01\x00\x50partial"} {
+		conn, err := net.Dial("tcp", rl.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conn.Write([]byte(sent))
+		conn.(*net.TCPConn).CloseWrite()
+		reply, _ := io.ReadAll(conn)
+		conn.Close()
+		select {
+		case got := <-received:
+			if string(got) != sent || string(reply) != "bye" {
+				t.Errorf("sent %q, target got %q, reply %q", sent, got, reply)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%q not forwarded", sent)
+		}
+	}
+}
@@ -10,7 +10,7 @@ require (
 	golang.org/x/crypto v0.27.0
 )
 
-require golang.org/x/net v0.23.0 // indirect
+require golang.org/x/net v0.23.0
 
 require (
 	github.com/andybalholm/brotli v1.0.6 // indirect
@@ -0,0 +1,209 @@
+package reality
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultHealthCheckInterval 默认检查模拟目标是否可达的间隔
+const defaultHealthCheckInterval = 30 * time.Second
+
+// targetDialTimeout 连接模拟目标的超时
+const targetDialTimeout = 5 * time.Second
+
+// unreachableHoldTimeout 目标都不可达时保持客户端连接的最长时间
+const unreachableHoldTimeout = 30 * time.Second
+
+// ErrTargetUnreachable 模拟目标和备用地址都无法连接
+var ErrTargetUnreachable = errors.New("all targets unreachable")
+
+// TargetStat 模拟目标的连接统计，计数从监听开始累计
+type TargetStat struct {
+	Addr      string
+	Up        bool
+	Dials     uint64 // 转发连接时的连接次数
+	Failures  uint64 // 转发连接和检查时连接失败的次数
+	LastError string
+}
+
+// targetHealth 记录模拟目标是否可达，转发时优先连接可达的地址
+type targetHealth struct {
+	lock        sync.Mutex
+	targets     map[string]*TargetStat
+	unreachable uint64 // 因所有地址都无法连接而放弃的连接数
+}
+
+func (h *targetHealth) target(addr string) *TargetStat {
+	if h.targets == nil {
+		h.targets = make(map[string]*TargetStat)
+	}
+	t, ok := h.targets[addr]
+	if !ok {
+		t = &TargetStat{Addr: addr, Up: true}
+		h.targets[addr] = t
+	}
+	return t
+}
+
+// record 记录一次连接结果，状态变化时输出日志
+func (h *targetHealth) record(addr string, dial bool, err error, logger logrus.FieldLogger) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	t := h.target(addr)
+	if dial {
+		t.Dials++
+	}
+	if err != nil {
+		t.Failures++
+		t.LastError = err.Error()
+		if t.Up {
+			logger.Errorf("camouflage target %s unreachable: %v", addr, err)
+		}
+		t.Up = false
+		return
+	}
+	if !t.Up {
+		logger.Infof("camouflage target %s recovered", addr)
+	}
+	t.Up = true
+}
+
+// order 返回连接顺序，可达的地址在前，均保持原顺序
+func (h *targetHealth) order(addrs []string) []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var up, down []string
+	for _, addr := range addrs {
+		if h.target(addr).Up {
+			up = append(up, addr)
+		} else {
+			down = append(down, addr)
+		}
+	}
+	return append(up, down...)
+}
+
+// dial 依次连接地址直到成功，都失败时返回ErrTargetUnreachable
+func (h *targetHealth) dial(addrs []string, logger logrus.FieldLogger) (net.Conn, string, error) {
+	var errs []error
+	for _, addr := range h.order(addrs) {
+		conn, err := net.DialTimeout("tcp", addr, targetDialTimeout)
+		h.record(addr, true, err, logger)
+		if err == nil {
+			return conn, addr, nil
+		}
+		errs = append(errs, err)
+	}
+	h.lock.Lock()
+	h.unreachable++
+	h.lock.Unlock()
+	return nil, "", errors.Join(append([]error{ErrTargetUnreachable}, errs...)...)
+}
+
+// check 连接每个地址检查是否可达
+func (h *targetHealth) check(addrs []string, logger logrus.FieldLogger) {
+	for _, addr := range addrs {
+		conn, err := net.DialTimeout("tcp", addr, targetDialTimeout)
+		if err == nil {
+			conn.Close()
+		}
+		h.record(addr, false, err, logger)
+	}
+}
+
+func (h *targetHealth) stats() ([]TargetStat, uint64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	targets := make([]TargetStat, 0, len(h.targets))
+	for _, t := range h.targets {
+		targets = append(targets, *t)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Addr < targets[j].Addr })
+	return targets, h.unreachable
+}
+
+// validateBackups 检查备用模拟目标地址
+func validateBackups(backups []string) error {
+	for _, addr := range backups {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("sni backup %s: %v", addr, err)
+		}
+	}
+	return nil
+}
+
+// targetCandidates 回落目标不可达时依次尝试SNIAddr和SNIBackups
+func (c *ServerConfig) targetCandidates(target string) []string {
+	candidates := []string{target}
+	if target != c.SNIAddr {
+		candidates = append(candidates, c.SNIAddr)
+	}
+	return append(candidates, c.SNIBackups...)
+}
+
+// healthTargets 需要检查的所有模拟目标
+func (c *ServerConfig) healthTargets() []string {
+	seen := make(map[string]bool)
+	var targets []string
+	add := func(addr string) {
+		if !seen[addr] {
+			seen[addr] = true
+			targets = append(targets, addr)
+		}
+	}
+	add(c.SNIAddr)
+	for _, addr := range c.SNIBackups {
+		add(addr)
+	}
+	names := make([]string, 0, len(c.Fallbacks))
+	for name := range c.Fallbacks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add(c.Fallbacks[name])
+	}
+	return targets
+}
+
+func (c *ServerConfig) healthCheckInterval() time.Duration {
+	if c.HealthCheckSecond == 0 {
+		return defaultHealthCheckInterval
+	}
+	return time.Duration(c.HealthCheckSecond) * time.Second
+}
+
+// checkTargets 定期检查模拟目标，间隔和地址随配置更新，监听关闭后返回
+func (l *Listener) checkTargets() {
+	for {
+		config := l.Config()
+		timer := time.NewTimer(config.healthCheckInterval())
+		select {
+		case <-timer.C:
+			l.health.check(config.healthTargets(), config.Logger)
+		case <-l.done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// TargetStats 返回各模拟目标的统计，以及因所有目标都不可达而放弃的连接数，
+// 私有握手需要转发目标的TLS握手，放弃的连接中也包括通过认证的客户端
+func (l *Listener) TargetStats() ([]TargetStat, uint64) {
+	return l.health.stats()
+}
+
+// holdConn 目标都不可达时，丢弃客户端数据直到对方关闭或超时，避免探测者立即收到RST
+func holdConn(conn net.Conn, timeout time.Duration) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	io.Copy(io.Discard, conn)
+}
@@ -0,0 +1,179 @@
+package reality_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/howmp/reality"
+)
+
+// deadAddr 返回一个没有监听的地址
+func deadAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func listenFallback(t *testing.T, config *reality.ServerConfig) *reality.Listener {
+	t.Helper()
+	config.Logger = reality.GetLogger(false)
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := reality.Listen("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l.(*reality.Listener)
+}
+
+func probe(t *testing.T, addr string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	tls.Client(conn, &tls.Config{ServerName: "a.com", InsecureSkipVerify: true}).Handshake()
+}
+
+func targetStat(l *reality.Listener, addr string) reality.TargetStat {
+	targets, _ := l.TargetStats()
+	for _, t := range targets {
+		if t.Addr == addr {
+			return t
+		}
+	}
+	return reality.TargetStat{}
+}
+
+func TestFallbackBackup(t *testing.T) {
+	accepted := make(chan string, 8)
+	dead := deadAddr(t)
+	backup := listenTarget(t, "backup", accepted)
+	config, err := reality.NewServerConfig(dead, "127.0.0.1:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.SNIBackups = []string{backup}
+	l := listenFallback(t, config)
+	for i := 0; i < 2; i++ {
+		probe(t, l.Addr().String())
+		select {
+		case <-accepted:
+		case <-time.After(time.Second):
+			t.Fatal("backup not used")
+		}
+	}
+	// 第二次连接优先使用可达的备用地址
+	if s := targetStat(l, dead); s.Up || s.Dials != 1 || s.Failures != 1 {
+		t.Fatalf("sni addr stat %+v", s)
+	}
+	if s := targetStat(l, backup); !s.Up || s.Dials != 2 {
+		t.Fatalf("backup stat %+v", s)
+	}
+}
+
+func TestFallbackUnreachable(t *testing.T) {
+	dead := deadAddr(t)
+	config, err := reality.NewServerConfig(dead, "127.0.0.1:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.HealthCheckSecond = 1
+	l := listenFallback(t, config)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, err := conn.Write([]byte("\x16\x03\x01\x00\x05hello")); err != nil {
+		t.Fatal(err)
+	}
+	// 目标不可达时保持连接，不立即关闭
+	var ne net.Error
+	if _, err := conn.Read(make([]byte, 1)); !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("connection closed: %v", err)
+	}
+	if _, unreachable := l.TargetStats(); unreachable != 1 {
+		t.Fatalf("unreachable %d", unreachable)
+	}
+
+	// 目标恢复后由检查更新状态
+	target, err := net.Listen("tcp", dead)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer target.Close()
+	deadline := time.Now().Add(3 * time.Second)
+	for !targetStat(l, dead).Up {
+		if time.Now().After(deadline) {
+			t.Fatalf("target not recovered %+v", targetStat(l, dead))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestBackupValidate(t *testing.T) {
+	config, err := reality.NewServerConfig("example.com:443", "1.2.3.4:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.SNIBackups = []string{"example.com"}
+	if err := config.Validate(); err == nil {
+		t.Fatal("invalid backup accepted")
+	}
+}
+
+// TestAllTargetsDown 所有目标都不可达时，探测者的连接被保持，通过认证的客户端立即被关闭而无法连接
+func TestAllTargetsDown(t *testing.T) {
+	config, err := reality.NewServerConfig(deadAddr(t), "127.0.0.1:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.SNIBackups = []string{deadAddr(t)}
+	l := listenFallback(t, config)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("\x16\x03\x01\x00\x05hello"))
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("probe should be held, got %v", err)
+	}
+
+	clientConfig := config.ToClientConfig(0)
+	clientConfig.ServerAddr = l.Addr().String()
+	clientConfig.SkipVerify = true
+	if err := clientConfig.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if _, err := reality.NewClient(ctx, clientConfig); err == nil {
+		t.Fatal("client should not connect without a live target")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("client closed after %s", elapsed)
+	}
+	if _, unreachable := l.TargetStats(); unreachable != 2 {
+		t.Fatalf("unreachable %d", unreachable)
+	}
+}
@@ -0,0 +1,69 @@
+package reality
+
+import (
+	"fmt"
+	"net"
+)
+
+// ListenerConfig 服务端的一个监听，每个监听有自己的端口和模拟目标，客户端和用户端可以从任意监听接入
+type ListenerConfig struct {
+	Listen     string            `json:"listen"`                // 监听地址，如:8443
+	SNIAddr    string            `json:"sni_addr"`              // 该监听模拟的目标
+	ServerAddr string            `json:"server_addr,omitempty"` // 客户端连接该监听使用的地址，不为空时生成客户端时加入备用地址
+	Fallbacks  map[string]string `json:"fallbacks,omitempty"`   // 该监听的回落目标，为空时使用ServerConfig.Fallbacks
+	SNIBackups []string          `json:"sni_backups,omitempty"` // SNIAddr不可达时依次尝试的地址
+}
+
+func (c *ListenerConfig) Validate() error {
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("listen %s: %v", c.Listen, err)
+	}
+	if _, _, err := net.SplitHostPort(c.SNIAddr); err != nil {
+		return fmt.Errorf("listen %s sni_addr %s: %v", c.Listen, c.SNIAddr, err)
+	}
+	if c.ServerAddr != "" {
+		if _, _, err := net.SplitHostPort(c.ServerAddr); err != nil {
+			return fmt.Errorf("listen %s server_addr %s: %v", c.Listen, c.ServerAddr, err)
+		}
+	}
+	if err := validateFallbacks(c.Fallbacks); err != nil {
+		return fmt.Errorf("listen %s: %w", c.Listen, err)
+	}
+	if err := validateBackups(c.SNIBackups); err != nil {
+		return fmt.Errorf("listen %s: %w", c.Listen, err)
+	}
+	return nil
+}
+
+// AllListeners 返回由ServerAddr端口和SNIAddr组成的主监听和所有额外监听
+func (c *ServerConfig) AllListeners() []*ListenerConfig {
+	_, port, _ := net.SplitHostPort(c.ServerAddr)
+	listeners := []*ListenerConfig{{Listen: ":" + port, SNIAddr: c.SNIAddr, ServerAddr: c.ServerAddr, SNIBackups: c.SNIBackups}}
+	return append(listeners, c.Listeners...)
+}
+
+// ForListener 返回使用该监听模拟目标的配置副本，l需已通过Validate
+func (c *ServerConfig) ForListener(l *ListenerConfig) *ServerConfig {
+	config := *c
+	config.SNIAddr = l.SNIAddr
+	config.sniHost, config.sniPort, _ = net.SplitHostPort(l.SNIAddr)
+	if l.Fallbacks != nil {
+		config.Fallbacks = l.Fallbacks
+	}
+	// 备用地址只对应顶层的SNIAddr
+	config.SNIBackups = l.SNIBackups
+	return &config
+}
+
+// listenerEndpoints 额外监听中配置了ServerAddr的，作为客户端的备用地址
+func (c *ServerConfig) listenerEndpoints() []*Endpoint {
+	var endpoints []*Endpoint
+	for _, l := range c.Listeners {
+		if l.ServerAddr == "" {
+			continue
+		}
+		host, _, _ := net.SplitHostPort(l.SNIAddr)
+		endpoints = append(endpoints, &Endpoint{Addr: l.ServerAddr, SNI: host})
+	}
+	return endpoints
+}
@@ -0,0 +1,57 @@
+package reality
+
+import "fmt"
+
+// minMuxWindowSize yamux要求的最小接收窗口
+const minMuxWindowSize = 256 * 1024
+
+const (
+	MuxModeYamux = "yamux" // 所有流复用一个连接，默认
+	MuxModeNone  = "none"  // 每个流使用独立的Reality连接，避免丢包链路上的队头阻塞
+)
+
+const (
+	DefaultMuxIdleConns = 4  // none模式下客户端预先建立的空闲连接数
+	maxMuxIdleConns     = 64 // 与服务端空闲连接队列长度一致
+)
+
+// MuxConfig 多路复用参数，为空的字段使用yamux默认值
+type MuxConfig struct {
+	Mode               string `json:"mode,omitempty"`                 // yamux或none，默认yamux
+	WindowSize         uint32 `json:"window_size,omitempty"`          // 每个流的最大接收窗口，字节，默认256KB，高延迟链路可以调大
+	KeepAliveSecond    uint32 `json:"keepalive_second,omitempty"`     // 心跳间隔，默认30秒，用于及时发现失效的NAT映射
+	MaxStreams         int    `json:"max_streams,omitempty"`          // 每个会话同时处理的流数量上限，超过时关闭新流，0不限制
+	WriteTimeoutSecond uint32 `json:"write_timeout_second,omitempty"` // 写超时，默认10秒
+	IdleConns          int    `json:"idle_conns,omitempty"`           // none模式下客户端保持的空闲连接数，服务端打开流时使用，默认4
+}
+
+func (c *MuxConfig) Validate() error {
+	switch c.Mode {
+	case "", MuxModeYamux, MuxModeNone:
+	default:
+		return fmt.Errorf("unknown mux mode %q", c.Mode)
+	}
+	if c.WindowSize != 0 && c.WindowSize < minMuxWindowSize {
+		return fmt.Errorf("mux window size must be at least %d", minMuxWindowSize)
+	}
+	if c.MaxStreams < 0 {
+		return fmt.Errorf("invalid mux max streams %d", c.MaxStreams)
+	}
+	if c.IdleConns < 0 || c.IdleConns > maxMuxIdleConns {
+		return fmt.Errorf("mux idle conns must be between 0 and %d", maxMuxIdleConns)
+	}
+	return nil
+}
+
+// Multiplexed 是否复用连接，c为nil时使用默认的yamux
+func (c *MuxConfig) Multiplexed() bool {
+	return c == nil || c.Mode != MuxModeNone
+}
+
+// IdleConnCount none模式下客户端保持的空闲连接数
+func (c *MuxConfig) IdleConnCount() int {
+	if c == nil || c.IdleConns == 0 {
+		return DefaultMuxIdleConns
+	}
+	return c.IdleConns
+}
@@ -0,0 +1,50 @@
+package reality
+
+import "fmt"
+
+// RateLimit 上下行限速，每秒字节数，0不限速
+//
+// 上行为用户端到客户端所在网络的方向，下行相反
+type RateLimit struct {
+	Upload   int64 `json:"upload,omitempty"`
+	Download int64 `json:"download,omitempty"`
+}
+
+func (r *RateLimit) Validate() error {
+	if r.Upload < 0 || r.Download < 0 {
+		return fmt.Errorf("invalid rate limit %d/%d", r.Upload, r.Download)
+	}
+	return nil
+}
+
+// RateLimitConfig 服务端限速，全局、按客户端id、按用户分别计算，流量需同时满足
+type RateLimitConfig struct {
+	Global  *RateLimit            `json:"global,omitempty"`
+	Clients map[byte]*RateLimit   `json:"clients,omitempty"`
+	Users   map[string]*RateLimit `json:"users,omitempty"`
+}
+
+func (c *RateLimitConfig) Validate() error {
+	if c.Global != nil {
+		if err := c.Global.Validate(); err != nil {
+			return fmt.Errorf("global: %w", err)
+		}
+	}
+	for id, r := range c.Clients {
+		if r == nil {
+			continue
+		}
+		if err := r.Validate(); err != nil {
+			return fmt.Errorf("client(id:%d): %w", id, err)
+		}
+	}
+	for name, r := range c.Users {
+		if r == nil {
+			continue
+		}
+		if err := r.Validate(); err != nil {
+			return fmt.Errorf("user(%s): %w", name, err)
+		}
+	}
+	return nil
+}
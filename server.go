@@ -1,408 +1,709 @@
-package reality
-
-import (
-	"bufio"
-	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/ecdh"
-	"crypto/ed25519"
-	"crypto/rand"
-	"encoding/base64"
-	"encoding/hex"
-	"errors"
-	"fmt"
-	"io"
-	"net"
-
-	"github.com/sirupsen/logrus"
-	"golang.org/x/crypto/cryptobyte"
-)
-
-type ServerConfig struct {
-	SNIAddr           string `json:"sni_addr"`
-	ServerAddr        string `json:"server_addr"`
-	SkipVerify        bool   `json:"skip_verify"`
-	PrivateKeyECDH    string `json:"private_key_ecdh"`
-	PrivateKeySign    string `json:"private_key_sign"`
-	ExpireSecond      uint32 `json:"expire_second"`
-	Debug             bool   `json:"debug"`
-	ClientFingerPrint string `json:"finger_print,omitempty"`
-
-	privateKeyECDH *ecdh.PrivateKey
-	privateKeySign ed25519.PrivateKey
-	sniHost        string
-	sniPort        string
-}
-
-func NewServerConfig(sniAddr string, serverAddr string) (*ServerConfig, error) {
-	privateKeyECDH, err := ecdh.X25519().GenerateKey(rand.Reader)
-	if err != nil {
-		return nil, err
-	}
-	_, privateKeySign, err := ed25519.GenerateKey(rand.Reader)
-	if err != nil {
-		return nil, err
-	}
-	sniHost, sniPort, err := net.SplitHostPort(sniAddr)
-	if err != nil {
-		return nil, err
-	}
-	return &ServerConfig{
-		SNIAddr:        sniAddr,
-		ServerAddr:     serverAddr,
-		PrivateKeyECDH: base64.StdEncoding.EncodeToString(privateKeyECDH.Bytes()),
-		PrivateKeySign: base64.StdEncoding.EncodeToString(privateKeySign),
-		ExpireSecond:   DefaultExpireSecond,
-		privateKeyECDH: privateKeyECDH,
-		privateKeySign: privateKeySign,
-		sniHost:        sniHost,
-		sniPort:        sniPort,
-	}, nil
-
-}
-
-func (c *ServerConfig) Validate() error {
-	if c.SNIAddr == "" {
-		return errors.New("SNI is required")
-	}
-	var err error
-	c.sniHost, c.sniPort, err = net.SplitHostPort(c.SNIAddr)
-	if err != nil {
-		return err
-	}
-	if c.ServerAddr == "" {
-		return errors.New("server address is required")
-	}
-	data, err := base64.StdEncoding.DecodeString(c.PrivateKeyECDH)
-	if err != nil {
-		return err
-	}
-	c.privateKeyECDH, err = ecdh.X25519().NewPrivateKey(data)
-	if err != nil {
-		return err
-	}
-	data, err = base64.StdEncoding.DecodeString(c.PrivateKeySign)
-	if err != nil {
-		return err
-	}
-	if len(data) != ed25519.PrivateKeySize {
-		return errors.New("private key sign length error")
-	}
-	c.privateKeySign = ed25519.PrivateKey(data)
-
-	if c.ExpireSecond == 0 {
-		c.ExpireSecond = DefaultExpireSecond
-	}
-
-	if c.ClientFingerPrint == "" {
-		c.ClientFingerPrint = "chrome"
-	}
-	return nil
-}
-func (c *ServerConfig) SNIHost() string {
-	return c.sniHost
-}
-
-func (c *ServerConfig) SNIPort() string {
-	return c.sniPort
-}
-func (s *ServerConfig) ToClientConfig(overlayData byte) *ClientConfig {
-
-	return &ClientConfig{
-		SNI:             s.sniHost,
-		ServerAddr:      s.ServerAddr,
-		SkipVerify:      s.SkipVerify,
-		PublicKeyECDH:   base64.StdEncoding.EncodeToString(s.privateKeyECDH.PublicKey().Bytes()),
-		PublicKeyVerify: base64.StdEncoding.EncodeToString(s.privateKeySign.Public().(ed25519.PublicKey)),
-		ExpireSecond:    s.ExpireSecond,
-		Debug:           s.Debug,
-		FingerPrint:     s.ClientFingerPrint,
-		OverlayData:     overlayData,
-	}
-}
-
-type Listener struct {
-	net.Listener
-	config   *ServerConfig
-	chanConn chan net.Conn
-	chanErr  chan error
-	logger   logrus.FieldLogger
-}
-
-func Listen(laddr string, config *ServerConfig) (net.Listener, error) {
-	inner, err := net.Listen("tcp", laddr)
-	if err != nil {
-		return nil, err
-	}
-	l := &Listener{
-		Listener: inner,
-		config:   config,
-		chanConn: make(chan net.Conn),
-		chanErr:  make(chan error),
-		logger:   GetLogger(config.Debug),
-	}
-
-	go func() {
-		for {
-			conn, err := l.Listener.Accept()
-			if err != nil {
-				l.chanErr <- err
-				close(l.chanConn)
-				return
-			}
-			go func() {
-				c, err := l.handshake(conn)
-				if err != nil {
-					if l.config.Debug {
-						l.logger.Warnln("handshake", conn.RemoteAddr(), err)
-					}
-				} else {
-					l.chanConn <- c
-				}
-			}()
-
-		}
-	}()
-	return l, nil
-}
-func (l *Listener) Accept() (net.Conn, error) {
-	if c, ok := <-l.chanConn; ok {
-		return c, nil
-	}
-	return nil, <-l.chanErr
-}
-
-// handshake 尝试处理私有握手,失败则进行客户端和代理目标转发，成功返回加密包装后的客户端连接
-func (l *Listener) handshake(clientConn net.Conn) (net.Conn, error) {
-	logger := l.logger
-	targetConn, err := net.Dial("tcp", l.config.SNIAddr)
-	if err != nil {
-		return nil, errors.Join(ErrProxyDie, err)
-	}
-	// bufio.Reader是为了在读数据时，不是一个一个record读取，而是模仿一次性读取尽可能多的record
-	// io.TeeReader是为了在读数据时，同时互相转发
-	clientReader := bufio.NewReader(io.TeeReader(clientConn, targetConn))
-	targetReader := bufio.NewReader(io.TeeReader(targetConn, clientConn))
-	var aead cipher.AEAD
-	var plaintext []byte
-	readClientHello := func() error {
-		recordClientHello, err := readTlsRecord(clientReader)
-		if err != nil {
-			return err
-		}
-		var random, sessionId []byte
-		s := cryptobyte.String(recordClientHello.recordData)
-		if !s.Skip(6) || // skip type(1) length(3) version(2)
-			!s.ReadBytes(&random, 32) ||
-			!s.ReadUint8LengthPrefixed((*cryptobyte.String)(&sessionId)) ||
-			len(sessionId) != 32 {
-			return fmt.Errorf("invalid client hello: %x", hex.EncodeToString(recordClientHello.recordData))
-		}
-		logger.Debugf("random(public for ecdh): %x", random)
-		logger.Debugf("sessionId(ciphertext): %x", sessionId)
-		pub, err := ecdh.X25519().NewPublicKey(random)
-		if err != nil {
-			return err
-		}
-		sessionKey, err := l.config.privateKeyECDH.ECDH(pub)
-		if err != nil {
-			return err
-		}
-		logger.Debugf("sessionKey: %x", sessionKey)
-
-		block, err := aes.NewCipher(sessionKey)
-		if err != nil {
-			return err
-		}
-		aead, err = cipher.NewGCMWithNonceSize(block, 8)
-		if err != nil {
-			return err
-		}
-		nonce, err := generateNonce(aead.NonceSize(), sessionKey, l.config.ExpireSecond)
-		if err != nil {
-			return err
-		}
-		logger.Debugf("nonce: %x", nonce)
-
-		plaintext, err = aead.Open(nil, nonce, sessionId, nil)
-		if err != nil {
-			return err
-		}
-		logger.Debugf("plaintext: %x", plaintext)
-
-		if !bytes.HasPrefix(plaintext, Prefix) {
-			return fmt.Errorf("invalid prefix: %x", plaintext[:len(Prefix)])
-		}
-		logger.Debug("handshake ok")
-		return nil
-	}
-	if err = readClientHello(); err != nil {
-		go dup(clientConn, targetConn)
-		return nil, errors.Join(ErrVerifyFailed, err)
-	}
-
-	if _, err = serverOrder1.wait(targetReader, logger); err != nil {
-		go dup(clientConn, targetConn)
-		return nil, err
-	}
-
-	if _, err = clientOrder.wait(clientReader, logger); err != nil {
-		go dup(clientConn, targetConn)
-		return nil, err
-	}
-	records, err := serverOrder2.wait(targetReader, logger)
-	if err != nil {
-		go dup(clientConn, targetConn)
-		return nil, err
-	}
-	// 客户端和代理目标的tls握手已经完成，可以关闭目标的连接
-	targetConn.Close()
-
-	// 获取模拟目标的seq，如果有的话
-	seq := [8]byte{}
-	copy(seq[:], seqNumerOne[:])
-	if len(records) > 0 {
-		record := records[len(records)-1]
-		recordData := record.recordData
-		if len(recordData) > len(seq) {
-			copy(seq[:], recordData[:len(seq)])
-		}
-	}
-	logger.Debugf("seqNumer: %x", seq)
-	incSeq(seq[:])
-
-	// 读取客户端发送的附加内容
-	record, err := readTlsRecord(clientConn)
-	if err != nil {
-		return nil, err
-	}
-	overlayData := record.recordData[len(record.recordData)-1]
-	logger.Debugf("overlayData: %x", overlayData)
-
-	// 发送服务端签名
-	sign := ed25519.Sign(ed25519.PrivateKey(l.config.privateKeySign), plaintext)
-	logger.Debugf("sign: %x", sign)
-	record = newTLSRecord(
-		recordTypeApplicationData, versionTLS12,
-		generateRandomData(append(seq[:], sign...)), // record数据前缀模仿seq
-	)
-	if _, err = record.writeTo(clientConn); err != nil {
-		clientConn.Close()
-		return nil, err
-	}
-	return newWarpConn(clientConn, aead, overlayData, seq), nil
-}
-
-// dup 转发两个连接
-func dup(clientConn net.Conn, proxyConn net.Conn) {
-	defer clientConn.Close()
-	defer proxyConn.Close()
-	go io.Copy(proxyConn, clientConn)
-	io.Copy(clientConn, proxyConn)
-}
-
-type recordOrders []struct {
-	recordType    byte
-	handshakeType byte
-	optional      bool
-}
-
-var serverOrder1 = recordOrders{
-	{
-		recordType:    recordTypeHandshake,
-		handshakeType: typeServerHello,
-	},
-	{
-		recordType:    recordTypeHandshake,
-		handshakeType: typeCertificate,
-	},
-	{
-		recordType:    recordTypeHandshake,
-		handshakeType: typeServerKeyExchange,
-	},
-	{
-		recordType:    recordTypeHandshake,
-		handshakeType: typeServerHelloDone,
-	},
-}
-
-var clientOrder = recordOrders{
-	{
-		recordType:    recordTypeHandshake,
-		handshakeType: typeCertificate,
-		optional:      true,
-	},
-	{
-		recordType:    recordTypeHandshake,
-		handshakeType: typeClientKeyExchange,
-	},
-	{
-		recordType:    recordTypeHandshake,
-		handshakeType: typeCertificateVerify,
-		optional:      true,
-	},
-	{
-		recordType: recordTypeChangeCipherSpec,
-	},
-	{
-		recordType: recordTypeHandshake, // Encrypted Handshake Message(Finished)
-	},
-}
-
-var serverOrder2 = recordOrders{
-	{
-		recordType:    recordTypeHandshake,
-		handshakeType: typeNewSessionTicket,
-		optional:      true,
-	},
-	{
-		recordType: recordTypeChangeCipherSpec,
-	},
-	{
-
-		recordType: recordTypeHandshake, // Encrypted Handshake Message(Finished)
-	},
-}
-
-func (orders recordOrders) wait(reader io.Reader, logger logrus.FieldLogger) ([]*tlsRecord, error) {
-	records := make([]*tlsRecord, 0, len(orders))
-	orderPos := 0
-	for {
-		record, err := readTlsRecord(reader)
-		if err != nil {
-			return nil, err
-		}
-		records = append(records, record)
-		for pos := orderPos; pos < len(orders); pos++ {
-			o := orders[pos]
-			if o.handshakeType != 0 {
-				// 需要判断握手类型
-				if len(record.recordData) != 0 &&
-					record.recordData[0] == o.handshakeType {
-					orderPos = pos + 1
-					break
-				}
-			} else {
-				orderPos = pos + 1
-				break
-			}
-
-			if o.optional {
-				// 如果当前类型是可选的，继续向下查找
-				logger.Debugf("try optional record: %+v", record)
-				orderPos = pos + 1
-				continue
-			} else {
-				return nil, fmt.Errorf(
-					"invalid record, want %+v, got %d %x,",
-					o, record.recordType, record.recordData,
-				)
-			}
-		}
-		if orderPos == len(orders) {
-			return records, nil
-		}
-	}
-
-}
+package reality
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+type ServerConfig struct {
+	SNIAddr           string                 `json:"sni_addr"`
+	ServerAddr        string                 `json:"server_addr"`
+	SkipVerify        bool                   `json:"skip_verify"`
+	PrivateKeyECDH    string                 `json:"private_key_ecdh"`
+	PrivateKeySign    string                 `json:"private_key_sign"`
+	ExpireSecond      uint32                 `json:"expire_second"`
+	Debug             bool                   `json:"debug"`
+	ClientFingerPrint string                 `json:"finger_print,omitempty"`
+	SessionPolicy     string                 `json:"session_policy,omitempty"`
+	GroupStrategy     string                 `json:"group_strategy,omitempty"`
+	Users             []*UserConfig          `json:"users,omitempty"`
+	ClientRules       []string               `json:"client_rules,omitempty"`
+	ClientPolicies    map[byte]*ClientPolicy `json:"client_policies,omitempty"`
+	Forwards          []*ForwardConfig       `json:"forwards,omitempty"`
+	Endpoints         []*Endpoint            `json:"endpoints,omitempty"`           // 客户端的备用服务端地址
+	Listeners         []*ListenerConfig      `json:"listeners,omitempty"`           // 额外的监听，与ServerAddr端口的主监听共用会话
+	Fallbacks         map[string]string      `json:"fallbacks,omitempty"`           // 按ClientHello中的SNI选择回落目标，支持*.example.com，未匹配时使用SNIAddr
+	SNIBackups        []string               `json:"sni_backups,omitempty"`         // SNIAddr不可达时依次尝试的地址，需提供与SNIAddr相同的网站
+	HealthCheckSecond uint32                 `json:"health_check_second,omitempty"` // 检查模拟目标是否可达的间隔，默认30秒
+	Mux               *MuxConfig             `json:"mux,omitempty"`                 // 多路复用参数，同时下发给客户端和用户端
+	RateLimits        *RateLimitConfig       `json:"rate_limits,omitempty"`         // 服务端限速，重新加载配置后对已有连接生效
+	Traffic           *TrafficConfig         `json:"traffic,omitempty"`             // 流量统计保存位置
+	Audit             *AuditConfig           `json:"audit,omitempty"`               // 审计日志，记录每个流的目标和结果
+	UnsafeLogKeys     bool                   `json:"unsafe_log_keys,omitempty"`     // 调试日志中输出会话密钥和nonce，仅用于排查问题
+
+	Logger logrus.FieldLogger `json:"-"` // 为nil时使用GetLogger(Debug)
+
+	privateKeyECDH *ecdh.PrivateKey
+	privateKeySign ed25519.PrivateKey
+	sniHost        string
+	sniPort        string
+}
+
+// 同一id的客户端重复连接时的处理策略
+const (
+	SessionPolicyReject  = "reject"  // 拒绝新连接，保留旧会话
+	SessionPolicyReplace = "replace" // 关闭旧会话，使用新连接
+	SessionPolicyGroup   = "group"   // 新旧会话同时保留，组成负载均衡组
+)
+
+// 负载均衡组内选择会话的策略
+const (
+	GroupStrategyRoundRobin   = "round-robin"   // 轮询
+	GroupStrategyLeastStreams = "least-streams" // 选择流最少的会话
+)
+
+// UserConfig 用户端身份，Clients为允许访问的客户端id
+type UserConfig struct {
+	Name         string `json:"name"`
+	Password     string `json:"password"`
+	Clients      []int  `json:"clients"`
+	DailyQuota   int64  `json:"daily_quota,omitempty"`   // 每日流量配额，上下行合计字节数，0不限制
+	MonthlyQuota int64  `json:"monthly_quota,omitempty"` // 每月流量配额
+}
+
+// Allowed 是否允许访问客户端id
+func (u *UserConfig) Allowed(id byte) bool {
+	for _, v := range u.Clients {
+		if v == int(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// TrafficConfig 按用户和客户端统计的流量定期保存到File
+type TrafficConfig struct {
+	File       string `json:"file"`
+	SaveSecond uint32 `json:"save_second,omitempty"` // 保存间隔，默认60秒
+}
+
+// AuditConfig 审计日志，每行一条JSON记录，超过MaxSizeMB后轮转
+type AuditConfig struct {
+	File       string `json:"file"`
+	MaxSizeMB  int    `json:"max_size_mb,omitempty"` // 单个文件大小上限，默认100MB
+	MaxBackups int    `json:"max_backups,omitempty"` // 保留的历史文件数，默认5
+}
+
+// ClientPolicy 服务端下发给客户端的运行时策略，客户端连接时及服务端重新加载配置时下发
+//
+// 字段为空时使用客户端内嵌配置中的默认值
+type ClientPolicy struct {
+	Rules           []string          `json:"rules,omitempty"`            // 目标访问规则，替换内嵌规则
+	DNSServer       string            `json:"dns_server,omitempty"`       // 解析域名使用的DNS服务器
+	DNSUpstreams    map[string]string `json:"dns_upstreams,omitempty"`    // 按域名后缀指定DNS服务器，优先于DNSServer
+	UploadLimit     int64             `json:"upload_limit,omitempty"`     // 上行限速，每秒字节数
+	DownloadLimit   int64             `json:"download_limit,omitempty"`   // 下行限速，每秒字节数
+	ReconnectSecond uint32            `json:"reconnect_second,omitempty"` // 断线重连间隔
+	LogLevel        string            `json:"log_level,omitempty"`        // 日志级别
+	Forwards        []*ClientForward  `json:"forwards,omitempty"`         // 客户端反向端口转发
+	Audit           bool              `json:"audit,omitempty"`            // 服务端开启审计时由服务端设置，配置中指定时校验失败
+}
+
+// ForwardConfig 服务端端口转发，服务端监听Listen，经客户端Client连接内网目标Target
+type ForwardConfig struct {
+	Listen string `json:"listen"`
+	Client int    `json:"client"`
+	Target string `json:"target"`
+}
+
+// ClientForward 客户端反向端口转发，客户端监听Listen，经服务端连接目标Target
+type ClientForward struct {
+	Listen string `json:"listen"`
+	Target string `json:"target"`
+}
+
+func NewServerConfig(sniAddr string, serverAddr string) (*ServerConfig, error) {
+	privateKeyECDH, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	_, privateKeySign, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sniHost, sniPort, err := net.SplitHostPort(sniAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &ServerConfig{
+		SNIAddr:        sniAddr,
+		ServerAddr:     serverAddr,
+		PrivateKeyECDH: base64.StdEncoding.EncodeToString(privateKeyECDH.Bytes()),
+		PrivateKeySign: base64.StdEncoding.EncodeToString(privateKeySign),
+		ExpireSecond:   DefaultExpireSecond,
+		SessionPolicy:  SessionPolicyReject,
+		privateKeyECDH: privateKeyECDH,
+		privateKeySign: privateKeySign,
+		sniHost:        sniHost,
+		sniPort:        sniPort,
+	}, nil
+
+}
+
+func (c *ServerConfig) Validate() error {
+	if c.SNIAddr == "" {
+		return errors.New("SNI is required")
+	}
+	var err error
+	c.sniHost, c.sniPort, err = net.SplitHostPort(c.SNIAddr)
+	if err != nil {
+		return err
+	}
+	if c.ServerAddr == "" {
+		return errors.New("server address is required")
+	}
+	for _, e := range c.Endpoints {
+		if _, _, err := net.SplitHostPort(e.Addr); err != nil {
+			return fmt.Errorf("endpoint %s: %v", e.Addr, err)
+		}
+	}
+	if err := validateFallbacks(c.Fallbacks); err != nil {
+		return err
+	}
+	if err := validateBackups(c.SNIBackups); err != nil {
+		return err
+	}
+	_, mainPort, err := net.SplitHostPort(c.ServerAddr)
+	if err != nil {
+		return fmt.Errorf("server address %s: %v", c.ServerAddr, err)
+	}
+	// 主监听绑定所有地址，额外监听不能使用相同端口
+	listens := make(map[string]bool)
+	for _, l := range c.Listeners {
+		if err := l.Validate(); err != nil {
+			return err
+		}
+		_, port, _ := net.SplitHostPort(l.Listen)
+		if port == mainPort || listens[l.Listen] {
+			return fmt.Errorf("listen %s is used by more than one listener", l.Listen)
+		}
+		listens[l.Listen] = true
+	}
+	if c.Mux != nil {
+		if err := c.Mux.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.RateLimits != nil {
+		if err := c.RateLimits.Validate(); err != nil {
+			return fmt.Errorf("rate limits: %w", err)
+		}
+	}
+	data, err := base64.StdEncoding.DecodeString(c.PrivateKeyECDH)
+	if err != nil {
+		return err
+	}
+	c.privateKeyECDH, err = ecdh.X25519().NewPrivateKey(data)
+	if err != nil {
+		return err
+	}
+	data, err = base64.StdEncoding.DecodeString(c.PrivateKeySign)
+	if err != nil {
+		return err
+	}
+	if len(data) != ed25519.PrivateKeySize {
+		return errors.New("private key sign length error")
+	}
+	c.privateKeySign = ed25519.PrivateKey(data)
+
+	if c.ExpireSecond == 0 {
+		c.ExpireSecond = DefaultExpireSecond
+	}
+
+	if c.ClientFingerPrint == "" {
+		c.ClientFingerPrint = "chrome"
+	}
+	switch c.SessionPolicy {
+	case "":
+		c.SessionPolicy = SessionPolicyReject
+	case SessionPolicyReject, SessionPolicyReplace, SessionPolicyGroup:
+	default:
+		return fmt.Errorf("unknown session policy: %s", c.SessionPolicy)
+	}
+	switch c.GroupStrategy {
+	case "":
+		c.GroupStrategy = GroupStrategyRoundRobin
+	case GroupStrategyRoundRobin, GroupStrategyLeastStreams:
+	default:
+		return fmt.Errorf("unknown group strategy: %s", c.GroupStrategy)
+	}
+	for id, p := range c.ClientPolicies {
+		if id >= 128 {
+			return fmt.Errorf("client policy: invalid client id %d", id)
+		}
+		if p == nil {
+			return fmt.Errorf("client(id:%d) policy is empty", id)
+		}
+		if p.Audit {
+			return fmt.Errorf("client(id:%d) policy: audit is set from the server audit config", id)
+		}
+		if p.LogLevel != "" {
+			if _, err := logrus.ParseLevel(p.LogLevel); err != nil {
+				return fmt.Errorf("client(id:%d) policy: %v", id, err)
+			}
+		}
+		for _, f := range p.Forwards {
+			if err := validateForward(f.Listen, f.Target); err != nil {
+				return fmt.Errorf("client(id:%d) policy: %v", id, err)
+			}
+		}
+		for suffix, server := range p.DNSUpstreams {
+			if strings.Trim(suffix, ".") == "" {
+				return fmt.Errorf("client(id:%d) policy: empty dns upstream suffix", id)
+			}
+			if _, _, err := net.SplitHostPort(server); err != nil {
+				return fmt.Errorf("client(id:%d) policy: dns upstream %s: %v", id, suffix, err)
+			}
+		}
+	}
+	for _, f := range c.Forwards {
+		if f.Client < 0 || f.Client >= 128 {
+			return fmt.Errorf("forward %s: invalid client id %d", f.Listen, f.Client)
+		}
+		if err := validateForward(f.Listen, f.Target); err != nil {
+			return err
+		}
+	}
+	names := make(map[string]bool, len(c.Users))
+	for _, u := range c.Users {
+		if u.Name == "" || u.Password == "" {
+			return errors.New("user name and password are required")
+		}
+		if len(u.Name) > 255 || len(u.Password) > 255 {
+			return fmt.Errorf("user %s: name or password too long", u.Name)
+		}
+		if names[u.Name] {
+			return fmt.Errorf("duplicate user: %s", u.Name)
+		}
+		names[u.Name] = true
+		for _, id := range u.Clients {
+			if id < 0 || id >= 128 {
+				return fmt.Errorf("user %s: invalid client id %d", u.Name, id)
+			}
+		}
+		if u.DailyQuota < 0 || u.MonthlyQuota < 0 {
+			return fmt.Errorf("user %s: invalid quota", u.Name)
+		}
+	}
+	if c.Traffic != nil && c.Traffic.File == "" {
+		return errors.New("traffic file is required")
+	}
+	if c.Audit != nil {
+		if c.Audit.File == "" {
+			return errors.New("audit file is required")
+		}
+		if c.Audit.MaxSizeMB < 0 || c.Audit.MaxBackups < 0 {
+			return errors.New("invalid audit rotation")
+		}
+	}
+	return nil
+}
+
+func validateForward(listen, target string) error {
+	if _, _, err := net.SplitHostPort(listen); err != nil {
+		return fmt.Errorf("forward listen %s: %v", listen, err)
+	}
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return fmt.Errorf("forward target %s: %v", target, err)
+	}
+	return nil
+}
+
+// User 根据用户名查找用户，不存在返回nil
+func (c *ServerConfig) User(name string) *UserConfig {
+	for _, u := range c.Users {
+		if u.Name == name {
+			return u
+		}
+	}
+	return nil
+}
+
+func (c *ServerConfig) SNIHost() string {
+	return c.sniHost
+}
+
+func (c *ServerConfig) SNIPort() string {
+	return c.sniPort
+}
+func (s *ServerConfig) ToClientConfig(overlayData byte) *ClientConfig {
+
+	return &ClientConfig{
+		SNI:             s.sniHost,
+		ServerAddr:      s.ServerAddr,
+		SkipVerify:      s.SkipVerify,
+		PublicKeyECDH:   base64.StdEncoding.EncodeToString(s.privateKeyECDH.PublicKey().Bytes()),
+		PublicKeyVerify: base64.StdEncoding.EncodeToString(s.privateKeySign.Public().(ed25519.PublicKey)),
+		ExpireSecond:    s.ExpireSecond,
+		Debug:           s.Debug,
+		FingerPrint:     s.ClientFingerPrint,
+		OverlayData:     overlayData,
+		Rules:           s.ClientRules,
+		Endpoints:       append(append([]*Endpoint(nil), s.Endpoints...), s.listenerEndpoints()...),
+		Mux:             s.Mux,
+	}
+}
+
+type Listener struct {
+	net.Listener
+	config   atomic.Pointer[ServerConfig] // Logger不为nil
+	chanConn chan net.Conn
+	done     chan struct{} // 底层监听出错或关闭后关闭
+	err      error
+	health   targetHealth
+}
+
+func Listen(laddr string, config *ServerConfig) (net.Listener, error) {
+	inner, err := net.Listen("tcp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	l := &Listener{
+		Listener: inner,
+		chanConn: make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	l.SetConfig(config)
+	go l.checkTargets()
+
+	go func() {
+		for {
+			conn, err := l.Listener.Accept()
+			if err != nil {
+				l.err = err
+				close(l.done)
+				return
+			}
+			go func() {
+				config := l.Config()
+				c, err := l.handshake(conn, config)
+				if err != nil {
+					if config.Debug {
+						config.Logger.Warnln("handshake", conn.RemoteAddr(), err)
+					}
+					return
+				}
+				select {
+				case l.chanConn <- c:
+				case <-l.done:
+					// 握手完成前监听已关闭
+					c.Close()
+				}
+			}()
+
+		}
+	}()
+	return l, nil
+}
+
+// SetConfig 替换配置，之后开始的握手使用新配置，config需已通过Validate，未设置Logger时沿用原来的
+func (l *Listener) SetConfig(config *ServerConfig) {
+	c := *config
+	if c.Logger == nil {
+		if old := l.config.Load(); old != nil {
+			c.Logger = old.Logger
+		} else {
+			c.Logger = GetLogger(c.Debug)
+		}
+	}
+	l.config.Store(&c)
+}
+
+func (l *Listener) Config() *ServerConfig {
+	return l.config.Load()
+}
+
+// Accept 底层监听关闭后返回其错误，之后才完成握手的连接会被关闭
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.chanConn:
+		return c, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// handshake 尝试处理私有握手,失败则进行客户端和代理目标转发，成功返回加密包装后的客户端连接
+func (l *Listener) handshake(clientConn net.Conn, config *ServerConfig) (net.Conn, error) {
+	logger := config.Logger
+	// 先读取ClientHello，按SNI选择回落目标，超时或读取出错时交给默认目标处理
+	clientConn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	hello, sni, helloErr := readClientHello(clientConn)
+	clientConn.SetReadDeadline(time.Time{})
+	// ClientHello完整时在连接目标前校验，目标都不可达时区分客户端和探测者
+	var aead cipher.AEAD
+	var plaintext []byte
+	verifyErr := helloErr
+	if verifyErr == nil {
+		aead, plaintext, verifyErr = config.verifyClientHello(hello[recordHeaderLen:])
+	}
+	targetConn, target, err := l.health.dial(config.targetCandidates(config.fallbackTarget(sni)), logger)
+	if err != nil {
+		if verifyErr == nil {
+			// 私有握手需要转发目标的TLS握手，目标都不可达时无法完成，立即关闭以便客户端尽快尝试其他服务端地址
+			logger.Errorf("client %s verified but all camouflage targets unreachable, close", clientConn.RemoteAddr())
+			clientConn.Close()
+			return nil, errors.Join(ErrProxyDie, err)
+		}
+		go holdConn(clientConn, unreachableHoldTimeout)
+		return nil, errors.Join(ErrProxyDie, err)
+	}
+	logger.Debugf("sni %q, target %s", sni, target)
+	// 已读取的ClientHello重新交给后续处理，并转发给目标
+	client := io.MultiReader(bytes.NewReader(hello), clientConn)
+	if helloErr != nil && !isTimeout(helloErr) {
+		// 不完整的record或连接已关闭，已读取的部分转发给目标，由目标响应
+		go dup(clientConn, client, targetConn)
+		return nil, errors.Join(ErrVerifyFailed, helloErr)
+	}
+	// bufio.Reader是为了在读数据时，不是一个一个record读取，而是模仿一次性读取尽可能多的record
+	// io.TeeReader是为了在读数据时，同时互相转发
+	clientReader := bufio.NewReader(io.TeeReader(client, targetConn))
+	targetReader := bufio.NewReader(io.TeeReader(targetConn, clientConn))
+	// 读取ClientHello的同时转发给目标，超时未读完的在这里校验
+	recordClientHello, err := readTlsRecord(clientReader)
+	if err == nil && helloErr != nil {
+		aead, plaintext, verifyErr = config.verifyClientHello(recordClientHello.recordData)
+	}
+	if err != nil || verifyErr != nil {
+		go dup(clientConn, client, targetConn)
+		return nil, errors.Join(ErrVerifyFailed, err, verifyErr)
+	}
+
+	if _, err = serverOrder1.wait(targetReader, logger); err != nil {
+		go dup(clientConn, client, targetConn)
+		return nil, err
+	}
+
+	if _, err = clientOrder.wait(clientReader, logger); err != nil {
+		go dup(clientConn, client, targetConn)
+		return nil, err
+	}
+	records, err := serverOrder2.wait(targetReader, logger)
+	if err != nil {
+		go dup(clientConn, client, targetConn)
+		return nil, err
+	}
+	// 客户端和代理目标的tls握手已经完成，可以关闭目标的连接
+	targetConn.Close()
+
+	// 获取模拟目标的seq，如果有的话
+	seq := [8]byte{}
+	copy(seq[:], seqNumerOne[:])
+	if len(records) > 0 {
+		record := records[len(records)-1]
+		recordData := record.recordData
+		if len(recordData) > len(seq) {
+			copy(seq[:], recordData[:len(seq)])
+		}
+	}
+	logger.Debugf("seqNumer: %x", seq)
+	incSeq(seq[:])
+
+	// 读取客户端发送的附加内容
+	record, err := readTlsRecord(clientConn)
+	if err != nil {
+		return nil, err
+	}
+	overlayData := record.recordData[len(record.recordData)-1]
+	logger.Debugf("overlayData: %x", overlayData)
+
+	// 发送服务端签名
+	sign := ed25519.Sign(ed25519.PrivateKey(config.privateKeySign), plaintext)
+	logger.Debugf("sign: %x", sign)
+	record = newTLSRecord(
+		recordTypeApplicationData, versionTLS12,
+		generateRandomData(append(seq[:], sign...)), // record数据前缀模仿seq
+	)
+	if _, err = record.writeTo(clientConn); err != nil {
+		clientConn.Close()
+		return nil, err
+	}
+	return newWarpConn(clientConn, aead, overlayData, seq), nil
+}
+
+// verifyClientHello 校验ClientHello中的私有握手数据，recordData为ClientHello record的内容
+func (c *ServerConfig) verifyClientHello(recordData []byte) (cipher.AEAD, []byte, error) {
+	logger := c.Logger
+	var random, sessionId []byte
+	s := cryptobyte.String(recordData)
+	if !s.Skip(6) || // skip type(1) length(3) version(2)
+		!s.ReadBytes(&random, 32) ||
+		!s.ReadUint8LengthPrefixed((*cryptobyte.String)(&sessionId)) ||
+		len(sessionId) != 32 {
+		return nil, nil, fmt.Errorf("invalid client hello: %x", hex.EncodeToString(recordData))
+	}
+	logger.Debugf("random(public for ecdh): %x", random)
+	logger.Debugf("sessionId(ciphertext): %x", sessionId)
+	pub, err := ecdh.X25519().NewPublicKey(random)
+	if err != nil {
+		return nil, nil, err
+	}
+	sessionKey, err := c.privateKeyECDH.ECDH(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.UnsafeLogKeys {
+		logger.Debugf("sessionKey: %x", sessionKey)
+	}
+
+	block, err := aes.NewCipher(sessionKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCMWithNonceSize(block, 8)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce, err := generateNonce(aead.NonceSize(), sessionKey, c.ExpireSecond)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.UnsafeLogKeys {
+		logger.Debugf("nonce: %x", nonce)
+	}
+
+	plaintext, err := aead.Open(nil, nonce, sessionId, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.UnsafeLogKeys {
+		logger.Debugf("plaintext: %x", plaintext)
+	}
+
+	if !bytes.HasPrefix(plaintext, Prefix) {
+		return nil, nil, fmt.Errorf("invalid prefix: %x", plaintext[:len(Prefix)])
+	}
+	logger.Debug("handshake ok")
+	return aead, plaintext, nil
+}
+
+// dup 转发两个连接，client为clientConn上尚未转发的数据
+func dup(clientConn net.Conn, client io.Reader, proxyConn net.Conn) {
+	defer clientConn.Close()
+	defer proxyConn.Close()
+	go io.Copy(proxyConn, client)
+	io.Copy(clientConn, proxyConn)
+}
+
+type recordOrders []struct {
+	recordType    byte
+	handshakeType byte
+	optional      bool
+}
+
+var serverOrder1 = recordOrders{
+	{
+		recordType:    recordTypeHandshake,
+		handshakeType: typeServerHello,
+	},
+	{
+		recordType:    recordTypeHandshake,
+		handshakeType: typeCertificate,
+	},
+	{
+		recordType:    recordTypeHandshake,
+		handshakeType: typeServerKeyExchange,
+	},
+	{
+		recordType:    recordTypeHandshake,
+		handshakeType: typeServerHelloDone,
+	},
+}
+
+var clientOrder = recordOrders{
+	{
+		recordType:    recordTypeHandshake,
+		handshakeType: typeCertificate,
+		optional:      true,
+	},
+	{
+		recordType:    recordTypeHandshake,
+		handshakeType: typeClientKeyExchange,
+	},
+	{
+		recordType:    recordTypeHandshake,
+		handshakeType: typeCertificateVerify,
+		optional:      true,
+	},
+	{
+		recordType: recordTypeChangeCipherSpec,
+	},
+	{
+		recordType: recordTypeHandshake, // Encrypted Handshake Message(Finished)
+	},
+}
+
+var serverOrder2 = recordOrders{
+	{
+		recordType:    recordTypeHandshake,
+		handshakeType: typeNewSessionTicket,
+		optional:      true,
+	},
+	{
+		recordType: recordTypeChangeCipherSpec,
+	},
+	{
+
+		recordType: recordTypeHandshake, // Encrypted Handshake Message(Finished)
+	},
+}
+
+func (orders recordOrders) wait(reader io.Reader, logger logrus.FieldLogger) ([]*tlsRecord, error) {
+	records := make([]*tlsRecord, 0, len(orders))
+	orderPos := 0
+	for {
+		record, err := readTlsRecord(reader)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+		for pos := orderPos; pos < len(orders); pos++ {
+			o := orders[pos]
+			if o.handshakeType != 0 {
+				// 需要判断握手类型
+				if len(record.recordData) != 0 &&
+					record.recordData[0] == o.handshakeType {
+					orderPos = pos + 1
+					break
+				}
+			} else {
+				orderPos = pos + 1
+				break
+			}
+
+			if o.optional {
+				// 如果当前类型是可选的，继续向下查找
+				logger.Debugf("try optional record: %+v", record)
+				orderPos = pos + 1
+				continue
+			} else {
+				return nil, fmt.Errorf(
+					"invalid record, want %+v, got %d %x,",
+					o, record.recordType, record.recordData,
+				)
+			}
+		}
+		if orderPos == len(orders) {
+			return records, nil
+		}
+	}
+
+}
@@ -0,0 +1,76 @@
+package reality_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/howmp/reality"
+)
+
+func TestListenerClose(t *testing.T) {
+	l, err := reality.Listen("127.0.0.1:0", &reality.ServerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		accepted <- err
+	}()
+	l.Close()
+	select {
+	case err := <-accepted:
+		if err == nil {
+			t.Fatal("accept should fail after close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("accept blocked after close")
+	}
+	if _, err := l.Accept(); err == nil {
+		t.Fatal("accept should keep failing after close")
+	}
+}
+
+func TestListenerSetConfig(t *testing.T) {
+	logger := reality.GetLogger(false)
+	l, err := reality.Listen("127.0.0.1:0", &reality.ServerConfig{SNIAddr: "a.com:443", Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	rl := l.(*reality.Listener)
+	rl.SetConfig(&reality.ServerConfig{SNIAddr: "b.com:443"})
+	if c := rl.Config(); c.SNIAddr != "b.com:443" || c.Logger != logger {
+		t.Fatalf("config %s %v", c.SNIAddr, c.Logger)
+	}
+}
+
+func TestServerListeners(t *testing.T) {
+	config, err := reality.NewServerConfig("example.com:443", "1.2.3.4:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Listeners = []*reality.ListenerConfig{
+		{Listen: ":8443", SNIAddr: "www.example.org:443", ServerAddr: "1.2.3.4:8443"},
+		{Listen: "127.0.0.1:9443", SNIAddr: "www.example.net:443"},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	all := config.AllListeners()
+	if len(all) != 3 || all[0].Listen != ":443" || all[0].SNIAddr != "example.com:443" {
+		t.Fatalf("listeners %+v", all[0])
+	}
+	if c := config.ForListener(all[1]); c.SNIHost() != "www.example.org" || c.SNIAddr != "www.example.org:443" {
+		t.Fatalf("listener config %s", c.SNIAddr)
+	}
+	endpoints := config.ToClientConfig(0).Endpoints
+	if len(endpoints) != 1 || endpoints[0].Addr != "1.2.3.4:8443" || endpoints[0].SNI != "www.example.org" {
+		t.Fatalf("endpoints %v", endpoints)
+	}
+
+	config.Listeners = append(config.Listeners, &reality.ListenerConfig{Listen: "0.0.0.0:443", SNIAddr: "a.com:443"})
+	if err := config.Validate(); err == nil {
+		t.Fatal("listen port conflict accepted")
+	}
+}
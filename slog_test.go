@@ -0,0 +1,27 @@
+//go:build go1.21
+
+package reality_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/howmp/reality"
+)
+
+func TestSlogLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := reality.NewSlogLogger(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	logger.Debugf("hidden")
+	logger.WithField("id", 1).Warnf("hello %s", "world")
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("%v: %s", err, buf.String())
+	}
+	if record["msg"] != "hello world" || record["level"] != "WARN" || record["id"] != float64(1) {
+		t.Fatalf("record %v", record)
+	}
+}